@@ -1,10 +1,14 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/middleware"
+	"github.com/baohuamap/zchat-api/pkg/imgproc"
 	"github.com/baohuamap/zchat-api/service"
 	"github.com/gin-gonic/gin"
 )
@@ -23,20 +27,47 @@ type Handler interface {
 	GetFriends(ctx *gin.Context)
 	LoadConversations(ctx *gin.Context)
 	LoadMessages(ctx *gin.Context)
+	SendMessage(ctx *gin.Context)
 	SeenMessages(ctx *gin.Context)
 	UploadAvatar(ctx *gin.Context)
 	FindUsers(ctx *gin.Context)
 	GetUser(ctx *gin.Context)
+	UpdatePrivacy(ctx *gin.Context)
 	AddParticipants(ctx *gin.Context)
+	PromoteParticipant(ctx *gin.Context)
+	DemoteParticipant(ctx *gin.Context)
+	RemoveParticipant(ctx *gin.Context)
+	LeaveConversation(ctx *gin.Context)
+	UpdateConversation(ctx *gin.Context)
+	UpdateConversationSettings(ctx *gin.Context)
+	ClearHistory(ctx *gin.Context)
+	HideConversation(ctx *gin.Context)
+	PinMessage(ctx *gin.Context)
+	UnpinMessage(ctx *gin.Context)
+	ListPinnedMessages(ctx *gin.Context)
+	UploadConversationAvatar(ctx *gin.Context)
+	CreateInviteLink(ctx *gin.Context)
+	ListInviteLinks(ctx *gin.Context)
+	RevokeInviteLink(ctx *gin.Context)
+	JoinByInvite(ctx *gin.Context)
+	ListJoinRequests(ctx *gin.Context)
+	ApproveJoinRequest(ctx *gin.Context)
+	RejectJoinRequest(ctx *gin.Context)
+	DiscoverChannels(ctx *gin.Context)
+	SubscribeChannel(ctx *gin.Context)
+	UploadAttachment(ctx *gin.Context)
+	GetStorageUsage(ctx *gin.Context)
 }
 
 type handler struct {
-	userService service.User
-	msgService  service.Message
+	userService    service.User
+	msgService     service.Message
+	storageService service.Storage
+	convService    service.Conversation
 }
 
-func NewHandler(u service.User, m service.Message) Handler {
-	return &handler{userService: u, msgService: m}
+func NewHandler(u service.User, m service.Message, st service.Storage, cs service.Conversation) Handler {
+	return &handler{userService: u, msgService: m, storageService: st, convService: cs}
 }
 
 func (h *handler) ServerStatus(ctx *gin.Context) {
@@ -293,7 +324,23 @@ func (h *handler) LoadConversations(c *gin.Context) {
 		return
 	}
 
-	conversations, err := h.msgService.LoadConversations(c.Request.Context(), userIDUint)
+	var filter dto.ConversationListFilter
+	archived, err := queryBool(c, "archived")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid archived"})
+		return
+	}
+	filter.Archived = archived != nil && *archived
+	if filter.Muted, err = queryBool(c, "muted"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid muted"})
+		return
+	}
+	if filter.Pinned, err = queryBool(c, "pinned"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pinned"})
+		return
+	}
+
+	conversations, err := h.msgService.LoadConversations(c.Request.Context(), userIDUint, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -316,8 +363,13 @@ func (h *handler) LoadMessages(c *gin.Context) {
 		return
 	}
 
-	messages, err := h.msgService.LoadMessages(c.Request.Context(), conversationIDUint)
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	messages, err := h.msgService.LoadMessages(c.Request.Context(), conversationIDUint, userID)
 	if err != nil {
+		if errors.Is(err, service.ErrNotParticipant) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -325,6 +377,43 @@ func (h *handler) LoadMessages(c *gin.Context) {
 	c.JSON(http.StatusOK, messages)
 }
 
+// SendMessage posts a message through the same pipeline as WebSocket
+// clients, for bots, integrations and fallback transports.
+func (h *handler) SendMessage(c *gin.Context) {
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conversationId"})
+		return
+	}
+
+	var req dto.SendMessageReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	senderID := c.GetUint64(middleware.AuthUserIDKey)
+	username := c.GetString(middleware.AuthUsernameKey)
+	res, err := h.msgService.SendMessage(c.Request.Context(), conversationID, senderID, username, &req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrEmptyMessage),
+			errors.Is(err, service.ErrMessageTooLong),
+			errors.Is(err, service.ErrInvalidClientMsgID):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrConversationNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrNotParticipant), errors.Is(err, service.ErrForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (h *handler) SeenMessages(c *gin.Context) {
 	userID := c.Param("userId")
 	if userID == "" {
@@ -379,7 +468,10 @@ func (h *handler) UploadAvatar(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	filename := fileHeader.Filename
+	if fileHeader.Size > imgproc.MaxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": imgproc.ErrTooLarge.Error()})
+		return
+	}
 	file, err := fileHeader.Open()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -387,9 +479,16 @@ func (h *handler) UploadAvatar(c *gin.Context) {
 	}
 	defer file.Close()
 
-	resp, err := h.userService.UploadAvatar(c.Request.Context(), userIDUint, filename, &file)
+	resp, err := h.userService.UploadAvatar(c.Request.Context(), userIDUint, file)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, imgproc.ErrTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, imgproc.ErrUnsupportedFormat), errors.Is(err, imgproc.ErrInvalidDimensions):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -445,6 +544,23 @@ func (h *handler) GetUser(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+func (h *handler) UpdatePrivacy(c *gin.Context) {
+	var req dto.UpdatePrivacyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+
+	user, err := h.userService.UpdatePrivacy(c.Request.Context(), userID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
 func (h *handler) AddParticipants(c *gin.Context) {
 	var req dto.AddParticipantsReq
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -464,11 +580,433 @@ func (h *handler) AddParticipants(c *gin.Context) {
 		return
 	}
 
-	err = h.msgService.AddParticipants(c.Request.Context(), conversationIDUint, req.Participants)
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	err = h.convService.AddParticipants(c.Request.Context(), conversationIDUint, actorID, req.Participants)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeConversationError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "add participants successfully"})
 }
+
+func (h *handler) PromoteParticipant(c *gin.Context) {
+	h.participantAction(c, h.convService.PromoteParticipant, "participant promoted")
+}
+
+func (h *handler) DemoteParticipant(c *gin.Context) {
+	h.participantAction(c, h.convService.DemoteParticipant, "participant demoted")
+}
+
+func (h *handler) RemoveParticipant(c *gin.Context) {
+	h.participantAction(c, h.convService.RemoveParticipant, "participant removed")
+}
+
+func (h *handler) LeaveConversation(c *gin.Context) {
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conversationId"})
+		return
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	if err := h.convService.LeaveConversation(c.Request.Context(), conversationID, userID); err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "left conversation"})
+}
+
+func (h *handler) UpdateConversation(c *gin.Context) {
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conversationId"})
+		return
+	}
+	var req dto.UpdateConversationReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.UpdateConversation(c.Request.Context(), conversationID, actorID, &req)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) UpdateConversationSettings(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+	var req dto.UpdateConversationSettingsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.UpdateSettings(c.Request.Context(), conversationID, userID, &req)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) ClearHistory(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+	// The body is optional; without one the whole history is cleared.
+	var req dto.ClearHistoryReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	if err := h.convService.ClearHistory(c.Request.Context(), conversationID, userID, req.UpToSeq); err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "history cleared"})
+}
+
+func (h *handler) HideConversation(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	if err := h.convService.HideConversation(c.Request.Context(), conversationID, userID); err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "conversation hidden"})
+}
+
+func (h *handler) PinMessage(c *gin.Context) {
+	h.conversationAction(c, "messageId", h.convService.PinMessage, "message pinned")
+}
+
+func (h *handler) UnpinMessage(c *gin.Context) {
+	h.conversationAction(c, "messageId", h.convService.UnpinMessage, "message unpinned")
+}
+
+func (h *handler) ListPinnedMessages(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.ListPinnedMessages(c.Request.Context(), conversationID, userID)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) UploadConversationAvatar(c *gin.Context) {
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conversationId"})
+		return
+	}
+
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if fileHeader.Size > imgproc.MaxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": imgproc.ErrTooLarge.Error()})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	resp, err := h.convService.UploadAvatar(c.Request.Context(), conversationID, actorID, file)
+	if err != nil {
+		switch {
+		case errors.Is(err, imgproc.ErrTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, imgproc.ErrUnsupportedFormat), errors.Is(err, imgproc.ErrInvalidDimensions):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			writeConversationError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) CreateInviteLink(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+	var req dto.CreateInviteLinkReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.CreateInviteLink(c.Request.Context(), conversationID, actorID, &req)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) ListInviteLinks(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.ListInviteLinks(c.Request.Context(), conversationID, actorID)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) RevokeInviteLink(c *gin.Context) {
+	h.conversationAction(c, "inviteId", h.convService.RevokeInviteLink, "invite link revoked")
+}
+
+func (h *handler) JoinByInvite(c *gin.Context) {
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.JoinByInvite(c.Request.Context(), c.Param("token"), userID)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) ListJoinRequests(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	res, err := h.convService.ListJoinRequests(c.Request.Context(), conversationID, actorID)
+	if err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) ApproveJoinRequest(c *gin.Context) {
+	h.conversationAction(c, "requestId", h.convService.ApproveJoinRequest, "join request approved")
+}
+
+func (h *handler) RejectJoinRequest(c *gin.Context) {
+	h.conversationAction(c, "requestId", h.convService.RejectJoinRequest, "join request rejected")
+}
+
+const (
+	defaultChannelPageSize = 20
+	maxChannelPageSize     = 50
+)
+
+// DiscoverChannels lists public channels whose name or description
+// matches the q query parameter.
+func (h *handler) DiscoverChannels(c *gin.Context) {
+	limit := defaultChannelPageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxChannelPageSize)
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+		offset = n
+	}
+
+	res, err := h.convService.DiscoverChannels(c.Request.Context(), c.Query("q"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *handler) SubscribeChannel(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+	if err := h.convService.Subscribe(c.Request.Context(), conversationID, userID); err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "subscribed"})
+}
+
+// participantAction runs an action of the authenticated user on the
+// participant named by the userId path parameter.
+func (h *handler) participantAction(c *gin.Context, change func(context.Context, uint64, uint64, uint64) error, done string) {
+	h.conversationAction(c, "userId", change, done)
+}
+
+// conversationAction runs an action of the authenticated user on the
+// conversation and the ID in the param path parameter.
+func (h *handler) conversationAction(c *gin.Context, param string, action func(context.Context, uint64, uint64, uint64) error, done string) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+	id, ok := paramID(c, param)
+	if !ok {
+		return
+	}
+
+	actorID := c.GetUint64(middleware.AuthUserIDKey)
+	if err := action(c.Request.Context(), conversationID, actorID, id); err != nil {
+		writeConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": done})
+}
+
+// queryBool parses an optional boolean query parameter; absent is nil.
+func queryBool(c *gin.Context, name string) (*bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// paramID parses a numeric path parameter, writing a 400 response and
+// returning false when it is not one.
+func paramID(c *gin.Context, name string) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeConversationError maps conversation service errors to responses.
+func writeConversationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrConversationNotFound), errors.Is(err, service.ErrParticipantMissing),
+		errors.Is(err, service.ErrInviteNotFound), errors.Is(err, service.ErrJoinRequestNotFound),
+		errors.Is(err, service.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInviteExpired), errors.Is(err, service.ErrInviteExhausted):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrNotParticipant), errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidRoleChange), errors.Is(err, service.ErrJoinRequestDecided),
+		errors.Is(err, service.ErrAlreadyParticipant):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrNameTooLong), errors.Is(err, service.ErrDescriptionTooLong),
+		errors.Is(err, service.ErrInvalidInvite), errors.Is(err, service.ErrInvalidSettings):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (h *handler) UploadAttachment(c *gin.Context) {
+	conversationID, ok := paramID(c, "conversationId")
+	if !ok {
+		return
+	}
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	resp, err := h.storageService.UploadAttachment(c.Request.Context(), userID, conversationID,
+		fileHeader.Filename, fileHeader.Header.Get("Content-Type"), fileHeader.Size, file)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrQuotaExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": service.ErrCodeQuotaExceeded})
+		case errors.Is(err, service.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) GetStorageUsage(c *gin.Context) {
+	userID := c.GetUint64(middleware.AuthUserIDKey)
+
+	usage, err := h.storageService.GetUsage(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Broker fans hub messages out to every zchat-api instance, including the
+// publishing one. Hubs only deliver what they receive from Deliveries, so a
+// message reaches local and remote clients through the same path.
+type Broker interface {
+	Publish(ctx context.Context, m *Message) error
+	Deliveries() <-chan *Message
+	Close() error
+}
+
+// memoryBroker loops messages back in-process. It is used for single-node
+// deployments and tests.
+type memoryBroker struct {
+	mu     sync.RWMutex
+	ch     chan *Message
+	closed bool
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{ch: make(chan *Message, 256)}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, m *Message) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	select {
+	case b.ch <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *memoryBroker) Deliveries() <-chan *Message {
+	return b.ch
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.ch)
+	}
+	return nil
+}
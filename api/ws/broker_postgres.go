@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pgChannel = "zchat_hub"
+	// pgMaxPayload stays under Postgres' 8000 byte NOTIFY limit. Larger
+	// messages are spilled to hub_event_payloads and notified by reference.
+	pgMaxPayload = 7500
+	pgRefPrefix  = "@"
+	// pgSpillTTL bounds how long spilled payloads are kept for slow nodes.
+	pgSpillTTL = 5 * time.Minute
+)
+
+type postgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	ch       chan *Message
+	done     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// NewPostgresBroker fans messages out with LISTEN/NOTIFY. db publishes and
+// dsn opens the dedicated listening connection.
+func NewPostgresBroker(db *sql.DB, dsn string) (Broker, error) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("error: hub broker listener: %v", err)
+		}
+		if ev == pq.ListenerEventReconnected {
+			log.Printf("hub broker reconnected; notifications sent meanwhile were lost")
+		}
+	})
+	if err := listener.Listen(pgChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &postgresBroker{
+		db:       db,
+		listener: listener,
+		ch:       make(chan *Message, 256),
+		done:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.listen()
+	return b, nil
+}
+
+func (b *postgresBroker) Publish(ctx context.Context, m *Message) error {
+	select {
+	case <-b.done:
+		return ErrBrokerClosed
+	default:
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	payload := string(data)
+	if len(payload) > pgMaxPayload {
+		var id int64
+		err := b.db.QueryRowContext(ctx,
+			`INSERT INTO hub_event_payloads (payload, created_at) VALUES ($1, now()) RETURNING id`, payload,
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+		payload = pgRefPrefix + strconv.FormatInt(id, 10)
+	}
+
+	_, err = b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, pgChannel, payload)
+	return err
+}
+
+func (b *postgresBroker) Deliveries() <-chan *Message {
+	return b.ch
+}
+
+func (b *postgresBroker) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+		b.wg.Wait()
+		close(b.ch)
+	})
+	return err
+}
+
+func (b *postgresBroker) listen() {
+	defer b.wg.Done()
+
+	cleanup := time.NewTicker(pgSpillTTL)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification signals a reconnect.
+			if n == nil {
+				continue
+			}
+			m, err := b.decode(n.Extra)
+			if err != nil {
+				log.Printf("error: hub broker decode: %v", err)
+				continue
+			}
+			select {
+			case b.ch <- m:
+			case <-b.done:
+				return
+			}
+
+		case <-cleanup.C:
+			_, err := b.db.Exec(`DELETE FROM hub_event_payloads WHERE created_at < $1`, time.Now().Add(-pgSpillTTL))
+			if err != nil {
+				log.Printf("error: hub broker cleanup: %v", err)
+			}
+		}
+	}
+}
+
+func (b *postgresBroker) decode(payload string) (*Message, error) {
+	if ref, ok := strings.CutPrefix(payload, pgRefPrefix); ok {
+		id, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		err = b.db.QueryRow(`SELECT payload FROM hub_event_payloads WHERE id = $1`, id).Scan(&payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var m Message
+	if err := json.Unmarshal([]byte(payload), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -2,52 +2,346 @@ package ws
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/baohuamap/zchat-api/dto"
 	"github.com/baohuamap/zchat-api/models"
 	"github.com/baohuamap/zchat-api/repository"
+	"github.com/baohuamap/zchat-api/service"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 )
 
 type Client struct {
-	Conn            *websocket.Conn
+	Conn *websocket.Conn
+	// codec encodes frames in the subprotocol negotiated on upgrade.
+	codec           Codec
 	Message         chan *Message
 	ID              string `json:"id"`
 	ConversationID  string `json:"conversationId"`
 	Username        string `json:"username"`
 	msgRepo         repository.MessageRepository
+	msgService      service.Message
 	convRepo        repository.ConversationRepository
 	participantRepo repository.ParticipantRepository
+
+	// multiplexed clients carry every conversation of the user over one
+	// socket; ConversationID is empty for them.
+	multiplexed bool
+	// joinRooms are the conversations joined on Register. The hub reads
+	// it, so it must not change once the client is registered. Later
+	// subscriptions live only in the hub, which also drops them when the
+	// user is removed from a conversation.
+	joinRooms []string
+	// resume asks the writer to replay messages after resumeSince before
+	// anything queued. replayedSeq is the last one replayed; live copies of
+	// those are dropped. All three belong to the writer once registered.
+	resume      bool
+	resumeSince uint64
+	replayedSeq uint64
+
+	typingMu sync.Mutex
+	typing   map[string]*typingState
+
+	// readLimit caps inbound frame size. limiter, when set, rate limits
+	// inbound frames; abuseThreshold rate-limited frames within abuseWindow
+	// close the connection. strikes are only touched by the read loop.
+	readLimit      int64
+	limiter        *userLimiter
+	abuseThreshold int
+	strikes        int
+	strikesReset   time.Time
+
+	// sendMu guards closing Message against concurrent sends.
+	sendMu      sync.Mutex
+	closed      bool
+	closeCode   int
+	closeReason string
+}
+
+type typingState struct {
+	lastSent time.Time
+	timer    *time.Timer
 }
 
+const (
+	// writeWait is the time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong from the peer.
+	pongWait = 60 * time.Second
+	// pingPeriod must be less than pongWait.
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize is the default largest frame accepted from the peer.
+	maxMessageSize = 64 << 10
+	// replayPageSize is how many missed messages are loaded at a time.
+	replayPageSize = 100
+	// sendQueueSize is the per-client outbound queue; a client that lets it
+	// fill up is evicted rather than stalling the hub.
+	sendQueueSize = 256
+)
+
+// CloseSlowConsumer is sent to clients evicted for not keeping up. They
+// should reconnect and resync history.
+const CloseSlowConsumer = 4001
+
+// CloseRemoved is sent to per-conversation clients whose user left or was
+// removed from the conversation.
+const CloseRemoved = 4002
+
+const (
+	// typingThrottle is the minimum interval between relayed typing starts
+	// from one client while it keeps typing.
+	typingThrottle = 2 * time.Second
+	// typingTimeout stops a typing indicator the client never cleared.
+	typingTimeout = 5 * time.Second
+)
+
+// Message is the hub's routing unit: an event addressed to a conversation,
+// or to users when UserIDs is set. It is JSON encoded to cross the Broker.
 type Message struct {
-	Content        string `json:"content"`
-	ConversationID string `json:"conversationId"`
-	Username       string `json:"username"`
+	ConversationID string `json:"conversationId,omitempty"`
+	// SenderID, when SkipSender is set, is excluded from delivery.
+	SenderID   string `json:"senderId,omitempty"`
+	SkipSender bool   `json:"skipSender,omitempty"`
+	// Seq is the message sequence number of message.new events.
+	Seq     uint64   `json:"seq,omitempty"`
+	UserIDs []string `json:"userIds,omitempty"`
+	// Evict removes UserIDs from ConversationID on every instance instead
+	// of delivering Event.
+	Evict bool   `json:"evict,omitempty"`
+	Event *Event `json:"event"`
+
+	// frames caches Event encoded per codec, so a broadcast to a large
+	// room is encoded and compressed once per codec, not once per client.
+	framesMu sync.Mutex
+	frames   map[Codec]*websocket.PreparedMessage
+}
+
+// frame returns m's event encoded with codec, preparing it on first use.
+func (m *Message) frame(codec Codec) (*websocket.PreparedMessage, error) {
+	m.framesMu.Lock()
+	defer m.framesMu.Unlock()
+
+	if pm, ok := m.frames[codec]; ok {
+		return pm, nil
+	}
+	data, err := codec.Encode(m.Event)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := websocket.NewPreparedMessage(codec.FrameType(), data)
+	if err != nil {
+		return nil, err
+	}
+	if m.frames == nil {
+		m.frames = make(map[Codec]*websocket.PreparedMessage)
+	}
+	m.frames[codec] = pm
+	return pm, nil
+}
+
+// eventHandler handles one client event type. A returned *ProtocolError is
+// sent back to the client as an error frame.
+type eventHandler func(c *Client, hub *Hub, ev *Event) error
+
+var dispatch = map[string]eventHandler{
+	EventMessageSend: handleMessageSend,
+	EventTyping:      handleTyping,
+	EventHeartbeat:   handleHeartbeat,
+	EventSubscribe:   handleSubscribe,
+	EventUnsubscribe: handleUnsubscribe,
+}
+
+func newClient(
+	conn *websocket.Conn, userID string, username string, conversationIDs []string, multiplexed bool,
+	msg repository.MessageRepository, conv repository.ConversationRepository, participant repository.ParticipantRepository,
+	msgService service.Message,
+) *Client {
+	cl := &Client{
+		Conn:            conn,
+		Message:         make(chan *Message, sendQueueSize),
+		codec:           jsonCodec{},
+		readLimit:       maxMessageSize,
+		ID:              userID,
+		Username:        username,
+		msgRepo:         msg,
+		msgService:      msgService,
+		convRepo:        conv,
+		participantRepo: participant,
+		multiplexed:     multiplexed,
+		joinRooms:       conversationIDs,
+		typing:          make(map[string]*typingState),
+	}
+	if !multiplexed && len(conversationIDs) == 1 {
+		cl.ConversationID = conversationIDs[0]
+	}
+	return cl
+}
+
+// trySend queues m without blocking. It reports false when the queue is
+// full; sends to a closed client are dropped.
+func (c *Client) trySend(m *Message) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return true
+	}
+	select {
+	case c.Message <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes the outbound queue once; the writer then sends a close
+// frame with code and reason.
+func (c *Client) closeSend(code int, reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.Message)
+}
+
+// closedReason returns the reason the outbound queue was closed with.
+func (c *Client) closedReason() string {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.closeReason
 }
 
 func (c *Client) writeMessage() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.Conn.Close()
 	}()
 
-	for {
-		message, ok := <-c.Message
-		if !ok {
+	if c.resume {
+		if err := c.replay(context.Background(), c.resumeSince); err != nil {
+			log.Printf("error: %v", err)
 			return
 		}
+	}
+
+	for {
+		select {
+		case message, ok := <-c.Message:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.sendMu.Lock()
+				code, reason := c.closeCode, c.closeReason
+				c.sendMu.Unlock()
+				c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				return
+			}
+
+			if message.Seq != 0 && message.Seq <= c.replayedSeq && message.ConversationID == c.ConversationID {
+				continue
+			}
+
+			pm, err := message.frame(c.codec)
+			if err != nil {
+				log.Printf("error: %v", err)
+				return
+			}
+			if err := c.Conn.WritePreparedMessage(pm); err != nil {
+				log.Printf("error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writeEvent(ev *Event) error {
+	data, err := c.codec.Encode(ev)
+	if err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(c.codec.FrameType(), data)
+}
+
+// replay writes the client's conversation messages after seq straight to
+// the socket. The writer runs it before draining the queue, where live
+// messages pile up meanwhile. Like history, it skips what the user
+// cleared and stops where a user who left the conversation left it.
+func (c *Client) replay(ctx context.Context, seq uint64) error {
+	convID, err := strconv.ParseUint(c.ConversationID, 10, 64)
+	if err != nil {
+		return err
+	}
+	userID, err := strconv.ParseUint(c.ID, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var before *time.Time
+	p, err := c.participantRepo.GetByUserIDAndConversationID(ctx, userID, convID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		p, err = c.participantRepo.GetFormerByUserIDAndConversationID(ctx, userID, convID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		before = &p.DeletedAt.Time
+	}
+	if err != nil {
+		return err
+	}
+	seq = max(seq, p.ClearedSeq)
 
-		c.Conn.WriteJSON(message)
+	for {
+		msgs, err := c.msgRepo.GetByConversationIDAfterSeq(ctx, convID, seq, before, replayPageSize)
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			ev := NewEvent(EventMessageNew, newMessagePayload(c.ConversationID, &msgs[i], msgs[i].Sender.Username))
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeEvent(ev); err != nil {
+				return err
+			}
+			seq = msgs[i].Seq
+		}
+		c.replayedSeq = seq
+
+		if len(msgs) < replayPageSize {
+			return nil
+		}
 	}
 }
 
 func (c *Client) readMessage(hub *Hub) {
 	defer func() {
-		hub.Unregister <- c
+		c.stopTyping(hub)
+		hub.Presence.Disconnect(c)
+		hub.unregister(c)
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(c.readLimit)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
 		_, m, err := c.Conn.ReadMessage()
 		if err != nil {
@@ -57,34 +351,286 @@ func (c *Client) readMessage(hub *Hub) {
 			break
 		}
 
-		convID, err := strconv.ParseUint(c.ConversationID, 10, 64)
-		if err != nil {
-			log.Printf("error: %v", err)
+		if c.limiter != nil && !c.limiter.Allow(c.ID) {
+			if c.strike() {
+				log.Printf("closing connection of user %s: rate limit abuse", c.ID)
+				c.Conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+					time.Now().Add(writeWait))
+				break
+			}
+			c.sendError("", ErrCodeRateLimited, "rate limit exceeded, slow down")
 			continue
 		}
 
-		senderID, err := strconv.ParseUint(c.ID, 10, 64)
+		ev, err := c.codec.Decode(m)
 		if err != nil {
-			log.Printf("error: %v", err)
+			c.sendError("", ErrCodeBadRequest, errBadFrame.Error())
+			continue
+		}
+		if ev.V != ProtocolVersion {
+			c.sendError(ev.ID, ErrCodeUnsupported, "unsupported protocol version "+strconv.Itoa(ev.V))
 			continue
 		}
 
-		msgObj := &models.Message{
-			Content:        string(m),
-			ConversationID: convID,
-			SenderID:       senderID,
+		handle, ok := dispatch[ev.Type]
+		if !ok {
+			c.sendError(ev.ID, ErrCodeUnknownEvent, "unknown event type "+strconv.Quote(ev.Type))
+			continue
 		}
-		if err := c.msgRepo.Create(context.Background(), msgObj); err != nil {
+
+		if err := handle(c, hub, ev); err != nil {
+			if evErr, ok := err.(*ProtocolError); ok {
+				c.sendError(ev.ID, evErr.Code, evErr.Message)
+				continue
+			}
 			log.Printf("error: %v", err)
-			continue
+			c.sendError(ev.ID, ErrCodeInternal, "internal server error")
 		}
+	}
+}
 
-		msg := &Message{
-			Content:        string(m),
-			ConversationID: c.ConversationID,
-			Username:       c.Username,
+// strike records a rate-limited frame and reports whether the connection
+// has now been limited abuseThreshold times within abuseWindow.
+func (c *Client) strike() bool {
+	now := time.Now()
+	if now.After(c.strikesReset) {
+		c.strikes = 0
+		c.strikesReset = now.Add(abuseWindow)
+	}
+	c.strikes++
+	return c.strikes >= c.abuseThreshold
+}
+
+// send queues an event for this client only. A client whose queue is full
+// is closed so it can resync.
+func (c *Client) send(ev *Event) {
+	if !c.trySend(&Message{ConversationID: c.ConversationID, Event: ev}) {
+		c.closeSend(CloseSlowConsumer, "slow consumer, resync")
+	}
+}
+
+// conversationFor resolves the conversation an event targets. Per-conversation
+// clients always target their own; multiplexed clients must name one the
+// hub still has them subscribed to.
+func (c *Client) conversationFor(hub *Hub, conversationID string) (string, error) {
+	if !c.multiplexed {
+		return c.ConversationID, nil
+	}
+	if conversationID == "" {
+		return "", &ProtocolError{Code: ErrCodeBadRequest, Message: "conversationId is required"}
+	}
+	if !hub.Subscribed(c, conversationID) {
+		return "", &ProtocolError{Code: ErrCodeNotSubscribed, Message: "not subscribed to conversation " + conversationID}
+	}
+	return conversationID, nil
+}
+
+func (c *Client) sendError(replyTo string, code string, message string) {
+	c.send(newErrorEvent(replyTo, code, message))
+}
+
+func handleMessageSend(c *Client, hub *Hub, ev *Event) error {
+	var p SendMessagePayload
+	if err := json.Unmarshal(ev.Payload, &p); err != nil || p.Content == "" {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "content is required"}
+	}
+
+	conversationID, err := c.conversationFor(hub, p.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	convID, err := strconv.ParseUint(conversationID, 10, 64)
+	if err != nil {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "invalid conversationId"}
+	}
+
+	senderID, err := strconv.ParseUint(c.ID, 10, 64)
+	if err != nil {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "invalid userId"}
+	}
+
+	res, err := c.msgService.SendMessage(context.Background(), convID, senderID, c.Username, &dto.SendMessageReq{
+		Content:     p.Content,
+		ClientMsgID: p.ClientMsgID,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrEmptyMessage),
+			errors.Is(err, service.ErrMessageTooLong),
+			errors.Is(err, service.ErrInvalidClientMsgID):
+			return &ProtocolError{Code: ErrCodeBadRequest, Message: err.Error()}
+		case errors.Is(err, service.ErrConversationNotFound), errors.Is(err, service.ErrNotParticipant),
+			errors.Is(err, service.ErrForbidden):
+			return &ProtocolError{Code: ErrCodeForbidden, Message: err.Error()}
 		}
+		return err
+	}
+
+	// Sending a message implicitly ends the typing indicator.
+	c.setTyping(hub, conversationID, false)
+
+	c.send(newEvent(EventMessageAck, ev.ID, AckPayload{
+		MessageID:   res.ID,
+		ClientMsgID: res.ClientMsgID,
+		Seq:         res.Seq,
+		CreatedAt:   res.CreatedAt,
+	}))
+	return nil
+}
+
+func newMessagePayload(conversationID string, m *models.Message, username string) MessagePayload {
+	return MessagePayload{
+		ID:             m.ID,
+		Seq:            m.Seq,
+		ClientMsgID:    clientMsgID(m),
+		ConversationID: conversationID,
+		SenderID:       strconv.FormatUint(m.SenderID, 10),
+		Username:       username,
+		Content:        m.Content,
+		CreatedAt:      m.CreatedAt,
+		Kind:           string(m.Kind),
+	}
+}
+
+func handleTyping(c *Client, hub *Hub, ev *Event) error {
+	var p TypingPayload
+	if err := json.Unmarshal(ev.Payload, &p); err != nil {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "invalid typing payload"}
+	}
+
+	conversationID, err := c.conversationFor(hub, p.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	c.setTyping(hub, conversationID, p.Typing)
+	return nil
+}
+
+func handleHeartbeat(c *Client, hub *Hub, ev *Event) error {
+	var p HeartbeatPayload
+	if len(ev.Payload) > 0 {
+		if err := json.Unmarshal(ev.Payload, &p); err != nil {
+			return &ProtocolError{Code: ErrCodeBadRequest, Message: "invalid heartbeat payload"}
+		}
+	}
+
+	hub.Presence.Heartbeat(c, p.Status)
+	return nil
+}
+
+func handleSubscribe(c *Client, hub *Hub, ev *Event) error {
+	if !c.multiplexed {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "subscriptions require a multiplexed connection"}
+	}
+
+	var p SubscriptionPayload
+	if err := json.Unmarshal(ev.Payload, &p); err != nil || p.ConversationID == "" {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "conversationId is required"}
+	}
+
+	if !hub.Subscribed(c, p.ConversationID) {
+		if err := hub.Authorize(context.Background(), p.ConversationID, c.ID); err != nil {
+			if errors.Is(err, ErrConversationNotFound) || errors.Is(err, ErrNotParticipant) {
+				return &ProtocolError{Code: ErrCodeForbidden, Message: "not a participant of conversation " + p.ConversationID}
+			}
+			return err
+		}
+
+		sendOrDone(hub.Subscribe, &Subscription{Client: c, ConversationID: p.ConversationID}, hub.done)
+	}
+
+	c.send(newEvent(EventSubscribed, ev.ID, p))
+	return nil
+}
+
+func handleUnsubscribe(c *Client, hub *Hub, ev *Event) error {
+	if !c.multiplexed {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "subscriptions require a multiplexed connection"}
+	}
+
+	var p SubscriptionPayload
+	if err := json.Unmarshal(ev.Payload, &p); err != nil || p.ConversationID == "" {
+		return &ProtocolError{Code: ErrCodeBadRequest, Message: "conversationId is required"}
+	}
+
+	if hub.Subscribed(c, p.ConversationID) {
+		c.setTyping(hub, p.ConversationID, false)
+		sendOrDone(hub.Unsubscribe, &Subscription{Client: c, ConversationID: p.ConversationID}, hub.done)
+	}
+
+	c.send(newEvent(EventUnsubscribed, ev.ID, p))
+	return nil
+}
+
+// setTyping relays typing state changes to the rest of a conversation.
+// Repeated starts are throttled and an unrefreshed start expires after
+// typingTimeout. Typing events are never persisted.
+func (c *Client) setTyping(hub *Hub, conversationID string, typing bool) {
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+
+	st, active := c.typing[conversationID]
+	if active {
+		st.timer.Stop()
+	}
+
+	if !typing {
+		if active {
+			delete(c.typing, conversationID)
+			hub.broadcast(c.typingMessage(conversationID, false))
+		}
+		return
+	}
+
+	if !active {
+		st = &typingState{}
+		c.typing[conversationID] = st
+	}
+	st.timer = time.AfterFunc(typingTimeout, func() {
+		c.setTyping(hub, conversationID, false)
+	})
+
+	if active && time.Since(st.lastSent) < typingThrottle {
+		return
+	}
+	st.lastSent = time.Now()
+	hub.broadcast(c.typingMessage(conversationID, true))
+}
+
+// stopTyping clears every typing indicator of the client.
+func (c *Client) stopTyping(hub *Hub) {
+	c.typingMu.Lock()
+	ids := make([]string, 0, len(c.typing))
+	for id := range c.typing {
+		ids = append(ids, id)
+	}
+	c.typingMu.Unlock()
+
+	for _, id := range ids {
+		c.setTyping(hub, id, false)
+	}
+}
+
+func (c *Client) typingMessage(conversationID string, typing bool) *Message {
+	return &Message{
+		ConversationID: conversationID,
+		SenderID:       c.ID,
+		SkipSender:     true,
+		Event: NewEvent(EventTyping, TypingPayload{
+			ConversationID: conversationID,
+			UserID:         c.ID,
+			Username:       c.Username,
+			Typing:         typing,
+		}),
+	}
+}
 
-		hub.Broadcast <- msg
+func clientMsgID(m *models.Message) string {
+	if m.ClientMsgID == nil {
+		return ""
 	}
+	return *m.ClientMsgID
 }
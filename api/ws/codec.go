@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols a client can request at upgrade time with
+// Sec-WebSocket-Protocol. Clients that request none speak JSON.
+const (
+	SubprotocolJSON     = "zchat.v1.json"
+	SubprotocolMsgpack  = "zchat.v1.msgpack"
+	SubprotocolProtobuf = "zchat.v1.protobuf"
+)
+
+// subprotocols is in server preference order: the first one the client
+// also offers wins.
+var subprotocols = []string{SubprotocolProtobuf, SubprotocolMsgpack, SubprotocolJSON}
+
+var errBadFrame = errors.New("frame is not a valid event envelope")
+
+// Codec translates events to and from the frames of one subprotocol.
+// Inside the server event payloads are always JSON, since events cross the
+// broker; codecs convert them at the socket.
+type Codec interface {
+	// FrameType is websocket.TextMessage or websocket.BinaryMessage.
+	FrameType() int
+	Encode(ev *Event) ([]byte, error)
+	// Decode parses a client frame. Payloads of known event types are
+	// converted to JSON; others are dropped and fail dispatch anyway.
+	Decode(data []byte) (*Event, error)
+}
+
+// codecFor returns the codec of a negotiated subprotocol.
+func codecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolMsgpack:
+		return msgpackCodec{}
+	case SubprotocolProtobuf:
+		return protobufCodec{}
+	default:
+		return jsonCodec{}
+	}
+}
+
+// payloadSchema describes the payload of one event type. field is the
+// payload's number in the Envelope oneof of pb/events.proto.
+type payloadSchema struct {
+	field int
+	new   func() any
+}
+
+// payloadSchemas lists the payload of every event type.
+// TestProtobufPayloadMembers checks it against the Protobuf codec.
+var payloadSchemas = map[string]payloadSchema{
+	EventMessageSend:  {10, func() any { return new(SendMessagePayload) }},
+	EventMessageNew:   {11, func() any { return new(MessagePayload) }},
+	EventMessageAck:   {12, func() any { return new(AckPayload) }},
+	EventSystemJoin:   {13, func() any { return new(SystemPayload) }},
+	EventSystemLeave:  {13, func() any { return new(SystemPayload) }},
+	EventTyping:       {14, func() any { return new(TypingPayload) }},
+	EventHeartbeat:    {15, func() any { return new(HeartbeatPayload) }},
+	EventPresence:     {16, func() any { return new(PresencePayload) }},
+	EventSubscribe:    {17, func() any { return new(SubscriptionPayload) }},
+	EventUnsubscribe:  {17, func() any { return new(SubscriptionPayload) }},
+	EventSubscribed:   {17, func() any { return new(SubscriptionPayload) }},
+	EventUnsubscribed: {17, func() any { return new(SubscriptionPayload) }},
+	EventError:        {18, func() any { return new(ErrorPayload) }},
+
+	EventConversationUpdated: {19, func() any { return new(ConversationPayload) }},
+}
+
+// typedPayload decodes ev's JSON payload into its schema struct. It
+// returns nil for events without a payload or of unknown type.
+func typedPayload(ev *Event) (any, error) {
+	schema, ok := payloadSchemas[ev.Type]
+	if !ok || len(ev.Payload) == 0 {
+		return nil, nil
+	}
+	p := schema.new()
+	if err := json.Unmarshal(ev.Payload, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Encode(ev *Event) ([]byte, error) {
+	return json.Marshal(ev)
+}
+
+func (jsonCodec) Decode(data []byte) (*Event, error) {
+	var ev Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, errBadFrame
+	}
+	return &ev, nil
+}
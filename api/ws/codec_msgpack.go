@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackCodec encodes the same envelope as JSON, field names included,
+// as MessagePack. Timestamps use the MessagePack timestamp extension.
+type msgpackCodec struct{}
+
+type msgpackEvent struct {
+	V       int                `json:"v"`
+	Type    string             `json:"type"`
+	ID      string             `json:"id,omitempty"`
+	Payload msgpack.RawMessage `json:"payload,omitempty"`
+}
+
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Encode(ev *Event) ([]byte, error) {
+	out := msgpackEvent{V: ev.V, Type: ev.Type, ID: ev.ID}
+
+	p, err := typedPayload(ev)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if out.Payload, err = marshalMsgpack(p); err != nil {
+			return nil, err
+		}
+	}
+	return marshalMsgpack(&out)
+}
+
+func (msgpackCodec) Decode(data []byte) (*Event, error) {
+	var in msgpackEvent
+	if err := unmarshalMsgpack(data, &in); err != nil {
+		return nil, errBadFrame
+	}
+
+	ev := &Event{V: in.V, Type: in.Type, ID: in.ID}
+	schema, ok := payloadSchemas[in.Type]
+	if !ok || len(in.Payload) == 0 {
+		return ev, nil
+	}
+
+	p := schema.new()
+	if err := unmarshalMsgpack(in.Payload, p); err != nil {
+		return nil, errBadFrame
+	}
+	var err error
+	if ev.Payload, err = json.Marshal(p); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// marshalMsgpack encodes v keyed by its json tags, so both codecs agree
+// on field names.
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalMsgpack(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
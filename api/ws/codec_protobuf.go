@@ -0,0 +1,214 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/baohuamap/zchat-api/api/ws/pb"
+)
+
+//go:generate protoc --proto_path=pb --go_out=pb --go_opt=paths=source_relative events.proto
+
+// protobufCodec encodes events as the Envelope message of pb/events.proto,
+// using the types generated from it.
+type protobufCodec struct{}
+
+// payloadOneof is the Envelope oneof holding the payload.
+var payloadOneof = (&pb.Envelope{}).ProtoReflect().Descriptor().Oneofs().ByName("payload")
+
+func (protobufCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (protobufCodec) Encode(ev *Event) ([]byte, error) {
+	env := &pb.Envelope{V: uint32(ev.V), Type: ev.Type, Id: ev.ID}
+
+	p, err := typedPayload(ev)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if err := setPBPayload(env, p); err != nil {
+			return nil, err
+		}
+	}
+	return proto.Marshal(env)
+}
+
+func (protobufCodec) Decode(data []byte) (*Event, error) {
+	var env pb.Envelope
+	if err := proto.Unmarshal(data, &env); err != nil {
+		return nil, errBadFrame
+	}
+	ev := &Event{V: int(env.V), Type: env.Type, ID: env.Id}
+
+	// A payload in a member other than the one of type is dropped.
+	schema, ok := payloadSchemas[ev.Type]
+	field := env.ProtoReflect().WhichOneof(payloadOneof)
+	if !ok || field == nil || int(field.Number()) != schema.field {
+		return ev, nil
+	}
+	var err error
+	if ev.Payload, err = json.Marshal(payloadFromPB(&env)); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// setPBPayload sets the Envelope oneof member of a payload struct.
+func setPBPayload(env *pb.Envelope, p any) error {
+	switch p := p.(type) {
+	case *SendMessagePayload:
+		env.Payload = &pb.Envelope_MessageSend{MessageSend: &pb.SendMessagePayload{
+			ConversationId: p.ConversationID,
+			Content:        p.Content,
+			ClientMsgId:    p.ClientMsgID,
+		}}
+	case *MessagePayload:
+		env.Payload = &pb.Envelope_MessageNew{MessageNew: &pb.MessagePayload{
+			Id:             p.ID,
+			Seq:            p.Seq,
+			ClientMsgId:    p.ClientMsgID,
+			ConversationId: p.ConversationID,
+			SenderId:       p.SenderID,
+			Username:       p.Username,
+			Content:        p.Content,
+			CreatedAt:      pbTime(p.CreatedAt),
+			Kind:           p.Kind,
+		}}
+	case *AckPayload:
+		env.Payload = &pb.Envelope_MessageAck{MessageAck: &pb.AckPayload{
+			MessageId:   p.MessageID,
+			ClientMsgId: p.ClientMsgID,
+			Seq:         p.Seq,
+			CreatedAt:   pbTime(p.CreatedAt),
+		}}
+	case *SystemPayload:
+		env.Payload = &pb.Envelope_System{System: &pb.SystemPayload{
+			ConversationId: p.ConversationID,
+			UserId:         p.UserID,
+			Username:       p.Username,
+		}}
+	case *TypingPayload:
+		env.Payload = &pb.Envelope_Typing{Typing: &pb.TypingPayload{
+			ConversationId: p.ConversationID,
+			UserId:         p.UserID,
+			Username:       p.Username,
+			Typing:         p.Typing,
+		}}
+	case *HeartbeatPayload:
+		env.Payload = &pb.Envelope_Heartbeat{Heartbeat: &pb.HeartbeatPayload{Status: p.Status}}
+	case *PresencePayload:
+		presence := &pb.PresencePayload{UserId: p.UserID, Status: p.Status}
+		if p.LastSeenAt != nil {
+			presence.LastSeenAt = pbTime(*p.LastSeenAt)
+		}
+		env.Payload = &pb.Envelope_Presence{Presence: presence}
+	case *SubscriptionPayload:
+		env.Payload = &pb.Envelope_Subscription{Subscription: &pb.SubscriptionPayload{ConversationId: p.ConversationID}}
+	case *ErrorPayload:
+		env.Payload = &pb.Envelope_Error{Error: &pb.ErrorPayload{Code: p.Code, Message: p.Message}}
+	case *ConversationPayload:
+		env.Payload = &pb.Envelope_Conversation{Conversation: &pb.ConversationPayload{
+			ConversationId: p.ConversationID,
+			Name:           p.Name,
+			Description:    p.Description,
+			AvatarSmall:    p.AvatarSmall,
+			AvatarMedium:   p.AvatarMedium,
+			AvatarLarge:    p.AvatarLarge,
+		}}
+	default:
+		return fmt.Errorf("protobuf: no Envelope member for %T", p)
+	}
+	return nil
+}
+
+// payloadFromPB converts the Envelope oneof member back into its payload
+// struct.
+func payloadFromPB(env *pb.Envelope) any {
+	switch p := env.Payload.(type) {
+	case *pb.Envelope_MessageSend:
+		return &SendMessagePayload{
+			ConversationID: p.MessageSend.GetConversationId(),
+			Content:        p.MessageSend.GetContent(),
+			ClientMsgID:    p.MessageSend.GetClientMsgId(),
+		}
+	case *pb.Envelope_MessageNew:
+		m := p.MessageNew
+		return &MessagePayload{
+			ID:             m.GetId(),
+			Seq:            m.GetSeq(),
+			ClientMsgID:    m.GetClientMsgId(),
+			ConversationID: m.GetConversationId(),
+			SenderID:       m.GetSenderId(),
+			Username:       m.GetUsername(),
+			Content:        m.GetContent(),
+			CreatedAt:      goTime(m.GetCreatedAt()),
+			Kind:           m.GetKind(),
+		}
+	case *pb.Envelope_MessageAck:
+		a := p.MessageAck
+		return &AckPayload{
+			MessageID:   a.GetMessageId(),
+			ClientMsgID: a.GetClientMsgId(),
+			Seq:         a.GetSeq(),
+			CreatedAt:   goTime(a.GetCreatedAt()),
+		}
+	case *pb.Envelope_System:
+		return &SystemPayload{
+			ConversationID: p.System.GetConversationId(),
+			UserID:         p.System.GetUserId(),
+			Username:       p.System.GetUsername(),
+		}
+	case *pb.Envelope_Typing:
+		return &TypingPayload{
+			ConversationID: p.Typing.GetConversationId(),
+			UserID:         p.Typing.GetUserId(),
+			Username:       p.Typing.GetUsername(),
+			Typing:         p.Typing.GetTyping(),
+		}
+	case *pb.Envelope_Heartbeat:
+		return &HeartbeatPayload{Status: p.Heartbeat.GetStatus()}
+	case *pb.Envelope_Presence:
+		presence := &PresencePayload{UserID: p.Presence.GetUserId(), Status: p.Presence.GetStatus()}
+		if ts := p.Presence.GetLastSeenAt(); ts != nil {
+			t := ts.AsTime()
+			presence.LastSeenAt = &t
+		}
+		return presence
+	case *pb.Envelope_Subscription:
+		return &SubscriptionPayload{ConversationID: p.Subscription.GetConversationId()}
+	case *pb.Envelope_Error:
+		return &ErrorPayload{Code: p.Error.GetCode(), Message: p.Error.GetMessage()}
+	case *pb.Envelope_Conversation:
+		c := p.Conversation
+		return &ConversationPayload{
+			ConversationID: c.GetConversationId(),
+			Name:           c.GetName(),
+			Description:    c.GetDescription(),
+			AvatarSmall:    c.GetAvatarSmall(),
+			AvatarMedium:   c.GetAvatarMedium(),
+			AvatarLarge:    c.GetAvatarLarge(),
+		}
+	}
+	return nil
+}
+
+// pbTime converts t to a Timestamp; the zero time is left unset.
+func pbTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// goTime converts an optional Timestamp; unset is the zero time.
+func goTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/baohuamap/zchat-api/api/ws/pb"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	seen := time.Date(2024, 5, 1, 12, 30, 0, 123000000, time.UTC)
+	events := []*Event{
+		NewEvent(EventMessageNew, MessagePayload{
+			ID:             42,
+			Seq:            7,
+			ClientMsgID:    "0b6c3b1e-6f43-4a53-9a59-3c1f2f1f8e10",
+			ConversationID: "3",
+			SenderID:       "1",
+			Username:       "alice",
+			Content:        "hello",
+			CreatedAt:      seen,
+		}),
+		NewEvent(EventTyping, TypingPayload{ConversationID: "3", Typing: true}),
+		NewEvent(EventPresence, PresencePayload{UserID: "1", Status: PresenceOffline, LastSeenAt: &seen}),
+		NewEvent(EventConversationUpdated, ConversationPayload{ConversationID: "3", Name: "team", AvatarSmall: "https://cdn/a_64.jpg"}),
+		newErrorEvent("abc", ErrCodeBadRequest, "content is required"),
+		NewEvent(EventHeartbeat, nil),
+	}
+
+	for _, name := range subprotocols {
+		codec := codecFor(name)
+		for _, want := range events {
+			data, err := codec.Encode(want)
+			if err != nil {
+				t.Fatalf("%s: encoding %s: %v", name, want.Type, err)
+			}
+			got, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s: decoding %s: %v", name, want.Type, err)
+			}
+			if got.V != want.V || got.Type != want.Type || got.ID != want.ID {
+				t.Fatalf("%s: envelope = %+v, want %+v", name, got, want)
+			}
+			if !sameJSON(t, got.Payload, want.Payload) {
+				t.Fatalf("%s: %s payload = %s, want %s", name, want.Type, got.Payload, want.Payload)
+			}
+		}
+	}
+}
+
+func TestCodecsRejectGarbage(t *testing.T) {
+	for _, name := range subprotocols {
+		if _, err := codecFor(name).Decode([]byte{0xff, 0xff, 0xff}); err == nil {
+			t.Fatalf("%s: decoding garbage succeeded", name)
+		}
+	}
+}
+
+func TestMessageFramePreparedOncePerCodec(t *testing.T) {
+	m := &Message{Event: NewEvent(EventHeartbeat, nil)}
+	for _, name := range subprotocols {
+		first, err := m.frame(codecFor(name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		second, _ := m.frame(codecFor(name))
+		if first != second {
+			t.Fatalf("%s: frame prepared twice", name)
+		}
+	}
+	if len(m.frames) != len(subprotocols) {
+		t.Fatalf("frames = %d, want one per codec (%d)", len(m.frames), len(subprotocols))
+	}
+}
+
+// TestProtobufPayloadMembers checks that every event type's payload is
+// sent in the Envelope oneof member payloadSchemas names, and read back
+// from it.
+func TestProtobufPayloadMembers(t *testing.T) {
+	codec := protobufCodec{}
+	for typ, schema := range payloadSchemas {
+		want := NewEvent(typ, schema.new())
+		data, err := codec.Encode(want)
+		if err != nil {
+			t.Fatalf("encoding %s: %v", typ, err)
+		}
+
+		var env pb.Envelope
+		if err := proto.Unmarshal(data, &env); err != nil {
+			t.Fatalf("unmarshalling %s: %v", typ, err)
+		}
+		field := env.ProtoReflect().WhichOneof(payloadOneof)
+		if field == nil || int(field.Number()) != schema.field {
+			t.Fatalf("%s: payload sent in %v, want field %d", typ, field, schema.field)
+		}
+
+		got, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", typ, err)
+		}
+		if !sameJSON(t, got.Payload, want.Payload) {
+			t.Fatalf("%s payload = %s, want %s", typ, got.Payload, want.Payload)
+		}
+	}
+}
+
+func sameJSON(t *testing.T, a, b json.RawMessage) bool {
+	t.Helper()
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	xs, _ := json.Marshal(x)
+	ys, _ := json.Marshal(y)
+	return bytes.Equal(xs, ys)
+}
@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Config tunes the WebSocket transport. Zero fields take the defaults
+// below.
+type Config struct {
+	// Compression negotiates permessage-deflate with clients that offer it.
+	Compression bool
+	// CompressionLevel is a compress/flate level; 0 keeps the default.
+	CompressionLevel int
+
+	// AllowedOrigins lists the Origin headers accepted on upgrade, e.g.
+	// "https://app.example.com". "*" accepts any origin. When empty only
+	// same-origin requests are accepted.
+	AllowedOrigins []string
+	// MaxMessageSize is the largest frame accepted from a client, in bytes.
+	// Larger frames close the connection.
+	MaxMessageSize int64
+
+	// RateLimit is the sustained number of frames per second a user may
+	// send, across all of their connections, and RateBurst how many may
+	// arrive at once.
+	RateLimit float64
+	RateBurst int
+	// AbuseThreshold is how many rate-limited frames within abuseWindow
+	// get a connection closed.
+	AbuseThreshold int
+}
+
+const (
+	defaultRateLimit      = 5
+	defaultRateBurst      = 20
+	defaultAbuseThreshold = 50
+)
+
+func (cfg Config) withDefaults() Config {
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = maxMessageSize
+	}
+	if cfg.RateLimit <= 0 {
+		cfg.RateLimit = defaultRateLimit
+	}
+	if cfg.RateBurst <= 0 {
+		cfg.RateBurst = defaultRateBurst
+	}
+	if cfg.AbuseThreshold <= 0 {
+		cfg.AbuseThreshold = defaultAbuseThreshold
+	}
+	return cfg
+}
+
+func newUpgrader(cfg Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		Subprotocols:      subprotocols,
+		EnableCompression: cfg.Compression,
+		CheckOrigin:       checkOrigin(cfg.AllowedOrigins),
+	}
+}
+
+// checkOrigin accepts requests without an Origin header, which browsers
+// always send, so non-browser clients are unaffected.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		// The upgrader's default same-origin check.
+		return nil
+	}
+
+	set := make(map[string]bool, len(allowed))
+	for _, o := range allowed {
+		if o == "*" {
+			return func(r *http.Request) bool { return true }
+		}
+		set[strings.ToLower(strings.TrimRight(o, "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || set[strings.ToLower(origin)]
+	}
+}
@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// ProtocolVersion is the envelope version spoken by this server.
+const ProtocolVersion = 1
+
+// Event types. Client-to-server types are the ones registered in dispatch.
+const (
+	EventMessageSend = "message.send"
+	EventMessageNew  = "message.new"
+	EventMessageAck  = "message.ack"
+	EventSystemJoin  = "system.join"
+	EventSystemLeave = "system.leave"
+	EventTyping      = "typing"
+	EventHeartbeat   = "heartbeat"
+	EventPresence    = "presence"
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+	// EventSubscribed and EventUnsubscribed answer the matching requests.
+	EventSubscribed   = "subscribed"
+	EventUnsubscribed = "unsubscribed"
+	// EventConversationUpdated carries a conversation's new name,
+	// description or avatar.
+	EventConversationUpdated = "conversation.updated"
+	EventError               = "error"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrCodeBadRequest    = "bad_request"
+	ErrCodeUnsupported   = "unsupported_version"
+	ErrCodeUnknownEvent  = "unknown_event"
+	ErrCodeInternal      = "internal_error"
+	ErrCodeForbidden     = "forbidden"
+	ErrCodeNotSubscribed = "not_subscribed"
+	ErrCodeRateLimited   = "rate_limited"
+	// ErrCodeResync tells a fallback client it was dropped and must
+	// reconnect and refetch history.
+	ErrCodeResync = "resync"
+)
+
+// Event is the envelope of every WebSocket frame in both directions.
+// For message.ack and error frames ID echoes the ID of the client frame
+// being answered.
+type Event struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload structs are the JSON and MessagePack schemas; the Protobuf codec
+// converts them to the types generated from pb/events.proto.
+
+type SendMessagePayload struct {
+	// ConversationID is required on multiplexed connections.
+	ConversationID string `json:"conversationId,omitempty"`
+	Content        string `json:"content"`
+	// ClientMsgID is a UUID chosen by the sender. Resending with the same
+	// one returns the original message instead of creating a duplicate.
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+}
+
+type MessagePayload struct {
+	ID             uint64    `json:"id"`
+	Seq            uint64    `json:"seq"`
+	ClientMsgID    string    `json:"clientMsgId,omitempty"`
+	ConversationID string    `json:"conversationId"`
+	SenderID       string    `json:"senderId"`
+	Username       string    `json:"username"`
+	Content        string    `json:"content"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// Kind is "text" or "system"; system messages describe conversation
+	// changes made by SenderID.
+	Kind string `json:"kind"`
+}
+
+type AckPayload struct {
+	MessageID   uint64    `json:"messageId"`
+	ClientMsgID string    `json:"clientMsgId,omitempty"`
+	Seq         uint64    `json:"seq"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type SystemPayload struct {
+	ConversationID string `json:"conversationId"`
+	UserID         string `json:"userId"`
+	Username       string `json:"username"`
+}
+
+type TypingPayload struct {
+	ConversationID string `json:"conversationId,omitempty"`
+	UserID         string `json:"userId,omitempty"`
+	Username       string `json:"username,omitempty"`
+	Typing         bool   `json:"typing"`
+}
+
+type SubscriptionPayload struct {
+	ConversationID string `json:"conversationId"`
+}
+
+type HeartbeatPayload struct {
+	Status string `json:"status"`
+}
+
+type PresencePayload struct {
+	UserID     string     `json:"userId"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+type ConversationPayload struct {
+	ConversationID string `json:"conversationId"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	AvatarSmall    string `json:"avatarSmall,omitempty"`
+	AvatarMedium   string `json:"avatarMedium,omitempty"`
+	AvatarLarge    string `json:"avatarLarge,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ProtocolError is returned by event handlers and sent back as an error frame.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// NewEvent builds a server event with a fresh ID.
+func NewEvent(typ string, payload any) *Event {
+	return newEvent(typ, newEventID(), payload)
+}
+
+func newEvent(typ string, id string, payload any) *Event {
+	ev := &Event{V: ProtocolVersion, Type: typ, ID: id}
+	if payload != nil {
+		// Payload types are plain structs, so marshalling cannot fail.
+		ev.Payload, _ = json.Marshal(payload)
+	}
+	return ev
+}
+
+func newErrorEvent(replyTo string, code string, message string) *Event {
+	return newEvent(EventError, replyTo, ErrorPayload{Code: code, Message: message})
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/baohuamap/zchat-api/dto"
+)
+
+// Fallback transports for clients that cannot keep a WebSocket open. Both
+// register a multiplexed hub client without a connection and drain its
+// queue over plain HTTP, so they see exactly the events a socket would.
+
+const (
+	// pollWait is how long a poll is held open waiting for an event.
+	pollWait = 25 * time.Second
+	// pollSessionTTL drops a poll session that was not polled again in time.
+	// Its client must start a new session and resync history.
+	pollSessionTTL = time.Minute
+	// pollMaxEvents caps the events returned by one poll.
+	pollMaxEvents = 100
+)
+
+// extendWriteDeadline gives the response d more to be written, beyond the
+// server's WriteTimeout, which would otherwise cut long polls and event
+// streams short.
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration) error {
+	return http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+}
+
+type pollSession struct {
+	client  *Client
+	timer   *time.Timer
+	polling bool
+}
+
+// Events streams the user's events as Server-Sent Events.
+func (h *handler) Events(c *gin.Context) {
+	clientID, username := authClient(c)
+
+	conversationIDs, ok := h.userConversationIDs(c, clientID)
+	if !ok {
+		return
+	}
+
+	cl := newClient(nil, clientID, username, conversationIDs, true, h.msg, h.conv, h.participant, h.msgService)
+	if !h.hub.register(cl) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+		return
+	}
+	h.hub.Presence.Connect(cl)
+	defer func() {
+		h.hub.Presence.Disconnect(cl)
+		h.hub.unregister(cl)
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop nginx from buffering the stream.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if err := extendWriteDeadline(c.Writer, writeWait); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case m, ok := <-cl.Message:
+			if !ok {
+				// Evicted as a slow consumer, or the server is shutting down.
+				writeSSE(c, newErrorEvent("", ErrCodeResync, cl.closedReason()))
+				return
+			}
+			if err := writeSSE(c, m.Event); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if err := extendWriteDeadline(c.Writer, writeWait); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+func writeSSE(c *gin.Context, ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if err := extendWriteDeadline(c.Writer, writeWait); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// Poll long-polls the user's events. The first poll omits cursor and
+// starts a session; later polls pass the returned cursor. Events queue up
+// in the session between polls.
+func (h *handler) Poll(c *gin.Context) {
+	clientID, username := authClient(c)
+	cursor := c.Query("cursor")
+
+	var s *pollSession
+	if cursor == "" {
+		var ok bool
+		if cursor, s, ok = h.openPoll(c, clientID, username); !ok {
+			return
+		}
+	} else {
+		h.pollMu.Lock()
+		s = h.polls[cursor]
+		if s == nil || s.client.ID != clientID {
+			h.pollMu.Unlock()
+			c.JSON(http.StatusNotFound, gin.H{"error": "poll session expired"})
+			return
+		}
+		if s.polling {
+			h.pollMu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "poll already in progress"})
+			return
+		}
+		s.polling = true
+		s.timer.Stop()
+		h.pollMu.Unlock()
+	}
+
+	defer func() {
+		h.pollMu.Lock()
+		s.polling = false
+		s.timer.Reset(pollSessionTTL)
+		h.pollMu.Unlock()
+	}()
+
+	events := make([]json.RawMessage, 0)
+	add := func(m *Message) {
+		if data, err := json.Marshal(m.Event); err == nil {
+			events = append(events, data)
+		}
+	}
+
+	// Events taken off the queue are lost if the response then fails.
+	if err := extendWriteDeadline(c.Writer, pollWait+writeWait); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+
+	select {
+	case m, ok := <-s.client.Message:
+		if !ok {
+			h.closePoll(cursor, s)
+			c.JSON(http.StatusGone, gin.H{"error": s.client.closedReason(), "code": ErrCodeResync})
+			return
+		}
+		add(m)
+	case <-timeout.C:
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	// Return whatever else is already queued.
+drain:
+	for len(events) < pollMaxEvents {
+		select {
+		case m, ok := <-s.client.Message:
+			if !ok {
+				break drain
+			}
+			add(m)
+		default:
+			break drain
+		}
+	}
+
+	c.JSON(http.StatusOK, &dto.PollRes{Cursor: cursor, Events: events})
+}
+
+func (h *handler) openPoll(c *gin.Context, clientID string, username string) (string, *pollSession, bool) {
+	conversationIDs, ok := h.userConversationIDs(c, clientID)
+	if !ok {
+		return "", nil, false
+	}
+
+	cl := newClient(nil, clientID, username, conversationIDs, true, h.msg, h.conv, h.participant, h.msgService)
+	if !h.hub.register(cl) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+		return "", nil, false
+	}
+	h.hub.Presence.Connect(cl)
+
+	cursor := newEventID()
+	s := &pollSession{client: cl, polling: true}
+	s.timer = time.AfterFunc(pollSessionTTL, func() { h.closePoll(cursor, s) })
+	s.timer.Stop()
+
+	h.pollMu.Lock()
+	h.polls[cursor] = s
+	h.pollMu.Unlock()
+	return cursor, s, true
+}
+
+// closePoll ends a poll session and releases its hub client.
+func (h *handler) closePoll(cursor string, s *pollSession) {
+	h.pollMu.Lock()
+	if h.polls[cursor] != s {
+		h.pollMu.Unlock()
+		return
+	}
+	delete(h.polls, cursor)
+	h.pollMu.Unlock()
+
+	h.hub.Presence.Disconnect(s.client)
+	h.hub.unregister(s.client)
+}
@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/middleware"
+)
+
+func TestPollOutlivesWriteTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hub := newTestHub(t)
+	h := NewHandler(hub, nil, nil, nil, nil, nil, nil, Config{}).(*handler)
+
+	cl := newClient(nil, "1", "alice", nil, true, nil, nil, nil, nil)
+	if !hub.register(cl) {
+		t.Fatal("hub refused client")
+	}
+	s := &pollSession{client: cl, timer: time.AfterFunc(time.Hour, func() {})}
+	h.polls["cursor"] = s
+	t.Cleanup(func() {
+		s.timer.Stop()
+		hub.unregister(cl)
+	})
+
+	r := gin.New()
+	r.GET("/ws/poll", func(c *gin.Context) {
+		c.Set(middleware.AuthUserIDKey, uint64(1))
+	}, h.Poll)
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// The event arrives well after the server's write timeout has passed.
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		hub.Direct <- &DirectMessage{
+			UserIDs: map[string]bool{"1": true},
+			Message: &Message{Event: NewEvent(EventHeartbeat, nil)},
+		}
+	}()
+
+	resp, err := http.Get(srv.URL + "/ws/poll?cursor=cursor")
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var res dto.PollRes
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("decoding poll: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(res.Events) != 1 {
+		t.Fatalf("poll = %d with %d events, want 200 with 1", resp.StatusCode, len(res.Events))
+	}
+}
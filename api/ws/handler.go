@@ -1,39 +1,67 @@
 package ws
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 
 	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/middleware"
 	"github.com/baohuamap/zchat-api/models"
 	"github.com/baohuamap/zchat-api/repository"
+	"github.com/baohuamap/zchat-api/service"
 )
 
 type Handler interface {
 	CreateConversation(c *gin.Context)
 	JoinConversation(c *gin.Context)
+	Connect(c *gin.Context)
 	GetClients(c *gin.Context)
+	GetFriendsPresence(c *gin.Context)
+	Events(c *gin.Context)
+	Poll(c *gin.Context)
 }
 
 type handler struct {
 	hub         *Hub
 	msg         repository.MessageRepository
+	msgService  service.Message
 	conv        repository.ConversationRepository
 	participant repository.ParticipantRepository
+	user        repository.UserRepository
+	friendship  repository.FriendshipRepository
+
+	cfg      Config
+	upgrader *websocket.Upgrader
+	limiter  *userLimiter
+
+	pollMu sync.Mutex
+	polls  map[string]*pollSession
 }
 
 func NewHandler(
 	h *Hub, conv repository.ConversationRepository, participant repository.ParticipantRepository,
-	msg repository.MessageRepository,
+	msg repository.MessageRepository, user repository.UserRepository, friendship repository.FriendshipRepository,
+	msgService service.Message, cfg Config,
 ) Handler {
 	return &handler{
 		hub:         h,
 		conv:        conv,
 		participant: participant,
 		msg:         msg,
+		msgService:  msgService,
+		user:        user,
+		friendship:  friendship,
+		cfg:         cfg.withDefaults(),
+		upgrader:    newUpgrader(cfg),
+		limiter:     newUserLimiter(cfg.withDefaults()),
+		polls:       make(map[string]*pollSession),
 	}
 }
 
@@ -46,88 +74,313 @@ func (h *handler) CreateConversation(c *gin.Context) {
 
 	conv := &models.Conversation{
 		Type:      req.Type,
-		CreatorID: req.CreatorID,
+		CreatorID: c.GetUint64(middleware.AuthUserIDKey),
 		Name:      req.Name,
 	}
-
-	if err := h.conv.Create(c, conv); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if conv.Type == models.ConversationTypeChannel {
+		conv.Public = req.Public
+	}
+	if conv.Type != models.ConversationTypePrivate {
+		// Groups and channels are owned by their creator, who is a member
+		// even when not listed.
+		req.Participants = append([]uint64{conv.CreatorID}, req.Participants...)
 	}
 
-	participants := make([]models.Participant, 0)
+	members := make([]uint64, 0, len(req.Participants))
+	seen := make(map[uint64]bool, len(req.Participants))
 	for _, userID := range req.Participants {
+		if !seen[userID] {
+			seen[userID] = true
+			members = append(members, userID)
+		}
+	}
+
+	if conv.Type == models.ConversationTypePrivate {
+		existing, ok := h.privateConversation(c, conv, members)
+		if !ok {
+			return
+		}
+		if existing != nil {
+			c.JSON(http.StatusOK, conversationRes(existing))
+			return
+		}
+	}
+
+	participants := make([]models.Participant, 0, len(members))
+	for _, userID := range members {
+		role := models.ParticipantRoleMember
+		if conv.Type != models.ConversationTypePrivate && userID == conv.CreatorID {
+			role = models.ParticipantRoleOwner
+		}
 		participants = append(participants, models.Participant{
-			UserID:         userID,
-			ConversationID: conv.ID,
+			UserID: userID,
+			Role:   role,
 		})
 	}
-	if err := h.participant.BulkCreate(c, participants); err != nil {
+
+	if err := h.conv.CreateWithParticipants(c, conv, participants); err != nil {
+		// Another request created the same pair's conversation first.
+		if conv.PairKey != nil {
+			if existing, err := h.conv.GetByPairKey(c, *conv.PairKey); err == nil {
+				c.JSON(http.StatusOK, conversationRes(existing))
+				return
+			}
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	convID := strconv.FormatUint(conv.ID, 10)
-	h.hub.Conversations[convID] = &Conversation{
-		ID:      convID,
-		Type:    conv.Type,
-		Creator: conv.CreatorID,
-		Clients: make(map[string]*Client),
+	h.hub.OpenConversation(strconv.FormatUint(conv.ID, 10), conv.Type, conv.CreatorID, members)
+
+	c.JSON(http.StatusOK, conversationRes(conv))
+}
+
+// privateConversation validates a new private conversation between the
+// creator and one other user and sets its pair key. It returns the pair's
+// existing conversation if there is one. On failure it writes the error
+// response and returns false.
+func (h *handler) privateConversation(c *gin.Context, conv *models.Conversation, members []uint64) (*models.Conversation, bool) {
+	if len(members) != 2 || (members[0] != conv.CreatorID && members[1] != conv.CreatorID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "private conversations need the creator and exactly one other participant"})
+		return nil, false
+	}
+	other := members[0]
+	if other == conv.CreatorID {
+		other = members[1]
+	}
+
+	key := pairKey(conv.CreatorID, other)
+	conv.PairKey = &key
+
+	existing, err := h.conv.GetByPairKey(c, key)
+	if err == nil {
+		return existing, true
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
 	}
 
-	res := &dto.CreateConversationRes{
-		ID:        convID,
+	allowed, err := h.canMessage(c, conv.CreatorID, other)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user only accepts conversations from friends"})
+		return nil, false
+	}
+	return nil, true
+}
+
+// canMessage reports whether from may start a private conversation with
+// to: they must be friends, or to must allow strangers. A block on either
+// side always forbids it.
+func (h *handler) canMessage(c *gin.Context, from uint64, to uint64) (bool, error) {
+	friends := false
+	for _, pair := range [][2]uint64{{from, to}, {to, from}} {
+		f, err := h.friendship.GetByUserIDAndFriendID(c, pair[0], pair[1])
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return false, err
+		}
+		switch f.Status {
+		case "blocked":
+			return false, nil
+		case "accepted":
+			friends = true
+		}
+	}
+	if friends {
+		return true, nil
+	}
+
+	u, err := h.user.Get(c, to)
+	if err != nil {
+		return false, err
+	}
+	return u.AllowStrangers, nil
+}
+
+// pairKey identifies the private conversation of two users regardless of
+// who started it.
+func pairKey(a uint64, b uint64) string {
+	if a > b {
+		a, b = b, a
+	}
+	return strconv.FormatUint(a, 10) + ":" + strconv.FormatUint(b, 10)
+}
+
+func conversationRes(conv *models.Conversation) *dto.CreateConversationRes {
+	return &dto.CreateConversationRes{
+		ID:        strconv.FormatUint(conv.ID, 10),
 		Type:      string(conv.Type),
 		CreatorID: conv.CreatorID,
 		Name:      conv.Name,
+		Public:    conv.Public,
 	}
-
-	c.JSON(http.StatusOK, res)
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// upgrade switches the request to a WebSocket. The client's codec follows
+// from the negotiated subprotocol.
+func (h *handler) upgrade(c *gin.Context) (*websocket.Conn, error) {
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.cfg.Compression && h.cfg.CompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(h.cfg.CompressionLevel); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 func (h *handler) JoinConversation(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	conversationID := c.Param("conversationId")
+	clientID, username := authClient(c)
+
+	// since resumes a dropped connection: messages after that sequence
+	// number are replayed before live delivery starts.
+	var since uint64
+	resume := c.Query("since") != ""
+	if resume {
+		var err error
+		if since, err = strconv.ParseUint(c.Query("since"), 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			return
+		}
+	}
+
+	if h.hub.Closed() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
 		return
 	}
 
-	conversationID := c.Param("conversationId")
-	clientID := c.Query("userId")
-	username := c.Query("username")
+	if err := h.hub.Authorize(c, conversationID, clientID); err != nil {
+		switch {
+		case errors.Is(err, ErrConversationNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
 
-	cl := &Client{
-		Conn:            conn,
-		Message:         make(chan *Message, 10),
-		ID:              clientID,
-		ConversationID:  conversationID,
-		Username:        username,
-		msgRepo:         h.msg,
-		convRepo:        h.conv,
-		participantRepo: h.participant,
+	conn, err := h.upgrade(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
+	cl := h.newSocketClient(conn, clientID, username, []string{conversationID}, false)
+	cl.resume = resume
+	cl.resumeSince = since
+
 	m := &Message{
-		Content:        "A new user has joined the conversation",
 		ConversationID: conversationID,
-		Username:       username,
+		Event: NewEvent(EventSystemJoin, SystemPayload{
+			ConversationID: conversationID,
+			UserID:         clientID,
+			Username:       username,
+		}),
+	}
+
+	if !h.hub.register(cl) {
+		closeGoingAway(conn)
+		return
+	}
+	h.hub.Presence.Connect(cl)
+	h.hub.broadcast(m)
+
+	cl.readMessage(h.hub)
+}
+
+// Connect opens a single multiplexed socket for a user. Every conversation
+// the user participates in is subscribed on connect; more can be added or
+// dropped with subscribe/unsubscribe events.
+func (h *handler) Connect(c *gin.Context) {
+	clientID, username := authClient(c)
+
+	conversationIDs, ok := h.userConversationIDs(c, clientID)
+	if !ok {
+		return
 	}
 
-	h.hub.Register <- cl
-	h.hub.Broadcast <- m
+	conn, err := h.upgrade(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cl := h.newSocketClient(conn, clientID, username, conversationIDs, true)
+
+	if !h.hub.register(cl) {
+		closeGoingAway(conn)
+		return
+	}
+	h.hub.Presence.Connect(cl)
 
-	go cl.writeMessage()
 	cl.readMessage(h.hub)
 }
 
+// authClient returns the ID and name of the user the request was
+// authenticated as. Browsers send the jwt cookie along with the upgrade.
+func authClient(c *gin.Context) (string, string) {
+	return strconv.FormatUint(c.GetUint64(middleware.AuthUserIDKey), 10), c.GetString(middleware.AuthUsernameKey)
+}
+
+// newSocketClient builds the client of an upgraded connection, with the
+// negotiated codec and the configured limits.
+func (h *handler) newSocketClient(
+	conn *websocket.Conn, clientID string, username string, conversationIDs []string, multiplexed bool,
+) *Client {
+	cl := newClient(conn, clientID, username, conversationIDs, multiplexed, h.msg, h.conv, h.participant, h.msgService)
+	cl.codec = codecFor(conn.Subprotocol())
+	cl.readLimit = h.cfg.MaxMessageSize
+	cl.limiter = h.limiter
+	cl.abuseThreshold = h.cfg.AbuseThreshold
+	return cl
+}
+
+// closeGoingAway turns away a connection upgraded while the hub shut down.
+func closeGoingAway(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, closeGoingAwayReason),
+		time.Now().Add(writeWait))
+	conn.Close()
+}
+
+// userConversationIDs lists the conversations of a user, writing an error
+// response and returning false when that fails.
+func (h *handler) userConversationIDs(c *gin.Context, clientID string) ([]string, bool) {
+	userID, err := strconv.ParseUint(clientID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid userId"})
+		return nil, false
+	}
+
+	conversations, err := h.participant.GetConversationByParticipants(c, userID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	conversationIDs := make([]string, 0, len(conversations))
+	for _, conv := range conversations {
+		conversationIDs = append(conversationIDs, strconv.FormatUint(conv.ID, 10))
+	}
+	return conversationIDs, true
+}
+
 // func (h *handler) GetConversations(c *gin.Context) {
 // 	conversations := make([]dto.ConversationRes, 0)
 
@@ -141,20 +394,46 @@ func (h *handler) JoinConversation(c *gin.Context) {
 // }
 
 func (h *handler) GetClients(c *gin.Context) {
-	var clients []dto.ClientRes
 	conversationId := c.Param("conversationId")
 
-	if _, ok := h.hub.Conversations[conversationId]; !ok {
-		clients = make([]dto.ClientRes, 0)
-		c.JSON(http.StatusOK, clients)
-	}
-
-	for _, c := range h.hub.Conversations[conversationId].Clients {
+	infos := h.hub.Clients(conversationId)
+	clients := make([]dto.ClientRes, 0, len(infos))
+	for _, cl := range infos {
 		clients = append(clients, dto.ClientRes{
-			ID:       c.ID,
-			Username: c.Username,
+			ID:       cl.ID,
+			Username: cl.Username,
 		})
 	}
 
 	c.JSON(http.StatusOK, clients)
 }
+
+func (h *handler) GetFriendsPresence(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid userId"})
+		return
+	}
+
+	friendIDs, err := h.friendship.GetAcceptedFriendIDs(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	res := dto.PresenceListRes{Friends: make([]dto.PresenceRes, 0, len(friendIDs))}
+	for _, id := range friendIDs {
+		p := dto.PresenceRes{
+			UserID: id,
+			Status: h.hub.Presence.Status(strconv.FormatUint(id, 10)),
+		}
+		if p.Status == PresenceOffline {
+			if u, err := h.user.Get(c, id); err == nil && !u.HideLastSeen {
+				p.LastSeenAt = u.LastSeenAt
+			}
+		}
+		res.Friends = append(res.Friends, p)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
@@ -1,64 +1,602 @@
 package ws
 
-import "github.com/baohuamap/zchat-api/models"
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+
+	"github.com/baohuamap/zchat-api/models"
+	"github.com/baohuamap/zchat-api/repository"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrNotParticipant       = errors.New("user is not a participant of the conversation")
+)
+
+const (
+	// roomIdleTTL is how long a room without clients stays in memory.
+	roomIdleTTL   = 10 * time.Minute
+	roomEvictTick = time.Minute
+	// shutdownGrace bounds how long writers may flush queued events on
+	// shutdown before their connections are closed under them.
+	shutdownGrace = 5 * time.Second
+)
+
+// closeGoingAwayReason tells clients the close is not their fault and they
+// should reconnect, possibly to another instance.
+const closeGoingAwayReason = "server shutting down, reconnect"
 
 type Conversation struct {
 	ID      string                  `json:"id"`
-	Type    models.ConversationType `json:"type"` // 1: private, 2: group
+	Type    models.ConversationType `json:"type"` // private, group or channel
 	Creator uint64                  `json:"creator"`
-	Clients map[string]*Client      `json:"clients"`
+	Clients map[*Client]bool        `json:"-"`
+	// Members caches participant user IDs; nil until loaded from the database.
+	Members   map[string]bool `json:"-"`
+	idleSince time.Time
 }
 
+// DirectMessage is delivered to every connection of the given users,
+// regardless of conversation.
+type DirectMessage struct {
+	UserIDs map[string]bool
+	Message *Message
+}
+
+// Subscription adds or removes a multiplexed client to or from a conversation.
+type Subscription struct {
+	Client         *Client
+	ConversationID string
+}
+
+// ClientInfo is a snapshot of a connected client, safe to use outside the hub.
+type ClientInfo struct {
+	ID       string
+	Username string
+}
+
+// Hub routes events between clients. All of its state is owned by the Run
+// goroutine; other goroutines talk to it through the channels below or the
+// query methods, which execute inside the run loop.
 type Hub struct {
-	Conversations map[string]*Conversation
-	Register      chan *Client
-	Unregister    chan *Client
-	Broadcast     chan *Message
+	Register    chan *Client
+	Unregister  chan *Client
+	Subscribe   chan *Subscription
+	Unsubscribe chan *Subscription
+	Broadcast   chan *Message
+	Direct      chan *DirectMessage
+	Presence    *Presence
+
+	conversations map[string]*Conversation
+	// clients maps every registered client to the conversations it is in.
+	clients map[*Client]map[string]bool
+	ops     chan func()
+	// done is closed when the hub shuts down; sends to the hub give up
+	// instead of blocking once it is.
+	done    chan struct{}
+	writers sync.WaitGroup
+
+	broker          Broker
+	convRepo        repository.ConversationRepository
+	participantRepo repository.ParticipantRepository
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		Conversations: make(map[string]*Conversation),
+func NewHub(
+	broker Broker, conv repository.ConversationRepository, participant repository.ParticipantRepository,
+	user repository.UserRepository, friendship repository.FriendshipRepository,
+) *Hub {
+	h := &Hub{
 		Register:      make(chan *Client),
 		Unregister:    make(chan *Client),
+		Subscribe:     make(chan *Subscription),
+		Unsubscribe:   make(chan *Subscription),
 		Broadcast:     make(chan *Message, 5),
+		Direct:        make(chan *DirectMessage, 5),
+		conversations: make(map[string]*Conversation),
+		clients:       make(map[*Client]map[string]bool),
+		ops:           make(chan func()),
+		done:          make(chan struct{}),
+
+		broker:          broker,
+		convRepo:        conv,
+		participantRepo: participant,
 	}
+	h.Presence = NewPresence(h, user, friendship)
+	return h
 }
 
-func (h *Hub) Run() {
+// Run routes events until ctx is cancelled, then closes every client with
+// a going-away frame, lets writers flush for up to shutdownGrace and
+// returns once they have all exited.
+func (h *Hub) Run(ctx context.Context) {
+	go h.Presence.Run(ctx)
+	go h.forward(ctx)
+
+	evict := time.NewTicker(roomEvictTick)
+	defer evict.Stop()
+
 	for {
 		select {
-		case cl := <-h.Register:
-			if _, ok := h.Conversations[cl.ConversationID]; ok {
-				r := h.Conversations[cl.ConversationID]
+		case <-ctx.Done():
+			h.shutdown()
+			return
 
-				if _, ok := r.Clients[cl.ID]; !ok {
-					r.Clients[cl.ID] = cl
-				}
+		case cl := <-h.Register:
+			// Clients are authorized before registering, so any room they
+			// name may be opened here.
+			h.clients[cl] = make(map[string]bool)
+			for _, id := range cl.joinRooms {
+				h.join(cl, id)
 			}
+			if cl.Conn != nil {
+				h.writers.Add(1)
+				go func() {
+					defer h.writers.Done()
+					cl.writeMessage()
+				}()
+			}
+
 		case cl := <-h.Unregister:
-			if _, ok := h.Conversations[cl.ConversationID]; ok {
-				if _, ok := h.Conversations[cl.ConversationID].Clients[cl.ID]; ok {
-					if len(h.Conversations[cl.ConversationID].Clients) != 0 {
-						h.Broadcast <- &Message{
-							Content:        "user left the chat",
-							ConversationID: cl.ConversationID,
+			rooms, ok := h.clients[cl]
+			if !ok {
+				continue
+			}
+			for id := range rooms {
+				h.leave(cl, id)
+				if !cl.multiplexed {
+					// Published off the run loop: the broker hands it back here.
+					go h.publish(ctx, &Message{
+						ConversationID: id,
+						Event: NewEvent(EventSystemLeave, SystemPayload{
+							ConversationID: id,
+							UserID:         cl.ID,
 							Username:       cl.Username,
-						}
-					}
-
-					delete(h.Conversations[cl.ConversationID].Clients, cl.ID)
-					close(cl.Message)
+						}),
+					})
 				}
 			}
+			delete(h.clients, cl)
+			cl.closeSend(websocket.CloseNormalClosure, "")
+
+		case s := <-h.Subscribe:
+			if _, ok := h.clients[s.Client]; ok {
+				h.join(s.Client, s.ConversationID)
+			}
 
-		case m := <-h.Broadcast:
-			if _, ok := h.Conversations[m.ConversationID]; ok {
+		case s := <-h.Unsubscribe:
+			if _, ok := h.clients[s.Client]; ok {
+				h.leave(s.Client, s.ConversationID)
+			}
 
-				for _, cl := range h.Conversations[m.ConversationID].Clients {
-					cl.Message <- m
-				}
+		case m, ok := <-h.broker.Deliveries():
+			if !ok {
+				return
+			}
+			if m.Evict {
+				h.evict(m)
+			} else if len(m.UserIDs) > 0 {
+				h.deliverToUsers(m)
+			} else {
+				h.deliver(m)
+			}
+
+		case op := <-h.ops:
+			op()
+
+		case now := <-evict.C:
+			h.evictIdle(now)
+		}
+	}
+}
+
+// shutdown closes every client and waits for their writers. Writers that
+// are still flushing after shutdownGrace have their connections closed.
+func (h *Hub) shutdown() {
+	close(h.done)
+
+	var conns []*websocket.Conn
+	for cl := range h.clients {
+		if cl.Conn != nil {
+			conns = append(conns, cl.Conn)
+		}
+		cl.closeSend(websocket.CloseGoingAway, closeGoingAwayReason)
+	}
+	h.clients = make(map[*Client]map[string]bool)
+	h.conversations = make(map[string]*Conversation)
+
+	flushed := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(flushed)
+	}()
+
+	grace := time.NewTimer(shutdownGrace)
+	defer grace.Stop()
+
+	select {
+	case <-flushed:
+	case <-grace.C:
+		for _, conn := range conns {
+			conn.Close()
+		}
+		<-flushed
+	}
+}
+
+// Closed reports whether the hub has shut down.
+func (h *Hub) Closed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// register hands cl to the run loop, which starts its writer. It reports
+// false once the hub has shut down.
+func (h *Hub) register(cl *Client) bool {
+	return sendOrDone(h.Register, cl, h.done)
+}
+
+func (h *Hub) unregister(cl *Client) {
+	sendOrDone(h.Unregister, cl, h.done)
+}
+
+func (h *Hub) broadcast(m *Message) {
+	sendOrDone(h.Broadcast, m, h.done)
+}
+
+// sendOrDone sends v on ch unless done is closed first.
+func sendOrDone[T any](ch chan<- T, v T, done <-chan struct{}) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// forward publishes locally produced messages to the broker, which hands
+// them back to the run loop of every instance.
+func (h *Hub) forward(ctx context.Context) {
+	for {
+		var m *Message
+		select {
+		case <-ctx.Done():
+			return
+		case m = <-h.Broadcast:
+		case dm := <-h.Direct:
+			m = &Message{Event: dm.Message.Event}
+			for id := range dm.UserIDs {
+				m.UserIDs = append(m.UserIDs, id)
+			}
+		}
+
+		h.publish(ctx, m)
+	}
+}
+
+func (h *Hub) publish(ctx context.Context, m *Message) {
+	// Publishes cut short by shutdown are expected.
+	if err := h.broker.Publish(ctx, m); err != nil && ctx.Err() == nil {
+		log.Printf("error: publishing hub message: %v", err)
+	}
+}
+
+// PublishMessage broadcasts a newly created message to its conversation.
+// It implements service.MessagePublisher.
+func (h *Hub) PublishMessage(m *models.Message, username string) {
+	conversationID := strconv.FormatUint(m.ConversationID, 10)
+	h.broadcast(&Message{
+		ConversationID: conversationID,
+		SenderID:       strconv.FormatUint(m.SenderID, 10),
+		Seq:            m.Seq,
+		Event:          NewEvent(EventMessageNew, newMessagePayload(conversationID, m, username)),
+	})
+}
+
+// PublishConversation tells a conversation's clients about its new name,
+// description or avatar. It implements service.MessagePublisher.
+func (h *Hub) PublishConversation(conv *models.Conversation) {
+	conversationID := strconv.FormatUint(conv.ID, 10)
+	h.broadcast(&Message{
+		ConversationID: conversationID,
+		Event: NewEvent(EventConversationUpdated, ConversationPayload{
+			ConversationID: conversationID,
+			Name:           conv.Name,
+			Description:    conv.Description,
+			AvatarSmall:    conv.AvatarSmall,
+			AvatarMedium:   conv.AvatarMedium,
+			AvatarLarge:    conv.AvatarLarge,
+		}),
+	})
+}
+
+// RemoveMember drops a user who left or was removed from a conversation
+// from its room on every instance. It implements service.MessagePublisher.
+func (h *Hub) RemoveMember(conversationID uint64, userID uint64) {
+	h.broadcast(&Message{
+		ConversationID: strconv.FormatUint(conversationID, 10),
+		UserIDs:        []string{strconv.FormatUint(userID, 10)},
+		Evict:          true,
+	})
+}
+
+// do runs f inside the run loop and waits for it to finish. After shutdown
+// f is not run.
+func (h *Hub) do(f func()) {
+	done := make(chan struct{})
+	op := func() {
+		f()
+		close(done)
+	}
+	if sendOrDone(h.ops, op, h.done) {
+		<-done
+	}
+}
+
+// OpenConversation creates or refreshes the room for a conversation.
+func (h *Hub) OpenConversation(id string, typ models.ConversationType, creator uint64, members []uint64) {
+	set := make(map[string]bool, len(members))
+	for _, m := range members {
+		set[strconv.FormatUint(m, 10)] = true
+	}
+
+	h.do(func() {
+		r := h.room(id)
+		r.Type = typ
+		r.Creator = creator
+		r.Members = set
+	})
+}
+
+// LoadConversation makes sure the room for a conversation exists with its
+// participant list, loading both from the database when needed.
+func (h *Hub) LoadConversation(ctx context.Context, id string) error {
+	var loaded bool
+	h.do(func() {
+		r, ok := h.conversations[id]
+		loaded = ok && r.Members != nil
+	})
+	if loaded {
+		return nil
+	}
+
+	convID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return ErrConversationNotFound
+	}
+	conv, err := h.convRepo.Get(ctx, convID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrConversationNotFound
+		}
+		return err
+	}
+
+	// Channels can have any number of subscribers, so their rooms start
+	// with an empty member cache that Authorize fills as users connect.
+	var members []uint64
+	if conv.Type != models.ConversationTypeChannel {
+		participants, err := h.participantRepo.GetByConversationID(ctx, convID)
+		if err != nil {
+			return err
+		}
+		members = make([]uint64, 0, len(participants))
+		for _, p := range participants {
+			members = append(members, p.UserID)
+		}
+	}
+	h.OpenConversation(id, conv.Type, conv.CreatorID, members)
+	return nil
+}
+
+// Authorize checks that userID may join conversationID, opening the room
+// on demand. Participants added since the room was loaded are picked up
+// from the database.
+func (h *Hub) Authorize(ctx context.Context, conversationID string, userID string) error {
+	if err := h.LoadConversation(ctx, conversationID); err != nil {
+		return err
+	}
+
+	var member bool
+	h.do(func() {
+		if r, ok := h.conversations[conversationID]; ok {
+			member = r.Members[userID]
+		}
+	})
+	if member {
+		return nil
+	}
+
+	convID, _ := strconv.ParseUint(conversationID, 10, 64)
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return ErrNotParticipant
+	}
+	if _, err := h.participantRepo.GetByUserIDAndConversationID(ctx, uid, convID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		return err
+	}
+
+	h.do(func() {
+		if r, ok := h.conversations[conversationID]; ok && r.Members != nil {
+			r.Members[userID] = true
+		}
+	})
+	return nil
+}
+
+// HasConversation reports whether a room exists for the conversation.
+func (h *Hub) HasConversation(id string) bool {
+	var ok bool
+	h.do(func() {
+		_, ok = h.conversations[id]
+	})
+	return ok
+}
+
+// Subscribed reports whether cl is currently in the conversation's room.
+// Evictions take users out of rooms behind their read loops' backs, so
+// this, not anything the client remembers, decides what it may target.
+func (h *Hub) Subscribed(cl *Client, conversationID string) bool {
+	var ok bool
+	h.do(func() {
+		ok = h.clients[cl][conversationID]
+	})
+	return ok
+}
+
+// Clients returns the distinct users connected to a conversation.
+func (h *Hub) Clients(conversationID string) []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	h.do(func() {
+		r, ok := h.conversations[conversationID]
+		if !ok {
+			return
+		}
+		seen := make(map[string]bool, len(r.Clients))
+		for cl := range r.Clients {
+			if seen[cl.ID] {
+				continue
 			}
+			seen[cl.ID] = true
+			clients = append(clients, ClientInfo{ID: cl.ID, Username: cl.Username})
+		}
+	})
+	return clients
+}
+
+// room returns the room for a conversation, creating an empty one.
+func (h *Hub) room(id string) *Conversation {
+	r, ok := h.conversations[id]
+	if !ok {
+		r = &Conversation{
+			ID:        id,
+			Clients:   make(map[*Client]bool),
+			idleSince: time.Now(),
+		}
+		h.conversations[id] = r
+	}
+	return r
+}
+
+func (h *Hub) join(cl *Client, conversationID string) {
+	h.room(conversationID).Clients[cl] = true
+	h.clients[cl][conversationID] = true
+}
+
+func (h *Hub) leave(cl *Client, conversationID string) {
+	if r, ok := h.conversations[conversationID]; ok {
+		delete(r.Clients, cl)
+		if len(r.Clients) == 0 {
+			r.idleSince = time.Now()
+		}
+	}
+	delete(h.clients[cl], conversationID)
+}
+
+// evictIdle drops rooms that have had no clients for roomIdleTTL. They are
+// reloaded from the database on the next join.
+func (h *Hub) evictIdle(now time.Time) {
+	for id, r := range h.conversations {
+		if len(r.Clients) == 0 && now.Sub(r.idleSince) > roomIdleTTL {
+			delete(h.conversations, id)
+		}
+	}
+}
+
+// evict takes the users of m out of its conversation's room. Multiplexed
+// clients are unsubscribed and told so; per-conversation clients are
+// closed with CloseRemoved.
+func (h *Hub) evict(m *Message) {
+	r, ok := h.conversations[m.ConversationID]
+	if !ok {
+		return
+	}
+
+	users := make(map[string]bool, len(m.UserIDs))
+	for _, id := range m.UserIDs {
+		users[id] = true
+		delete(r.Members, id)
+	}
+
+	for cl := range r.Clients {
+		if !users[cl.ID] {
+			continue
+		}
+		h.leave(cl, m.ConversationID)
+		if cl.multiplexed {
+			h.send(cl, &Message{
+				ConversationID: m.ConversationID,
+				Event:          NewEvent(EventUnsubscribed, SubscriptionPayload{ConversationID: m.ConversationID}),
+			})
+			continue
+		}
+		delete(h.clients, cl)
+		cl.closeSend(CloseRemoved, "removed from conversation")
+	}
+}
+
+func (h *Hub) deliverToUsers(m *Message) {
+	users := make(map[string]bool, len(m.UserIDs))
+	for _, id := range m.UserIDs {
+		users[id] = true
+	}
+
+	for cl := range h.clients {
+		if users[cl.ID] {
+			h.send(cl, m)
 		}
 	}
 }
+
+// quietInChannels are events not fanned out to channel audiences.
+var quietInChannels = map[string]bool{
+	EventSystemJoin:  true,
+	EventSystemLeave: true,
+	EventTyping:      true,
+}
+
+func (h *Hub) deliver(m *Message) {
+	r, ok := h.conversations[m.ConversationID]
+	if !ok {
+		return
+	}
+	if r.Type == models.ConversationTypeChannel && quietInChannels[m.Event.Type] {
+		return
+	}
+
+	for cl := range r.Clients {
+		if m.SkipSender && cl.ID == m.SenderID {
+			continue
+		}
+		h.send(cl, m)
+	}
+}
+
+// send queues m for cl without blocking the run loop. A client whose queue
+// is full is evicted with CloseSlowConsumer; its read loop unregisters it
+// later, which is then a no-op.
+func (h *Hub) send(cl *Client, m *Message) {
+	if cl.trySend(m) {
+		return
+	}
+
+	log.Printf("evicting slow client %s", cl.ID)
+	for id := range h.clients[cl] {
+		h.leave(cl, id)
+	}
+	delete(h.clients, cl)
+	cl.closeSend(CloseSlowConsumer, "slow consumer, resync")
+}
@@ -0,0 +1,420 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewHub(NewMemoryBroker(), nil, nil, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return h
+}
+
+// drain consumes a client's queue until the hub closes it and reports how
+// many events were received.
+func drain(cl *Client) <-chan int {
+	n := make(chan int, 1)
+	go func() {
+		count := 0
+		for range cl.Message {
+			count++
+		}
+		n <- count
+	}()
+	return n
+}
+
+func TestHubClientsMissingConversation(t *testing.T) {
+	h := newTestHub(t)
+
+	if got := h.Clients("404"); len(got) != 0 {
+		t.Fatalf("Clients() = %v, want empty", got)
+	}
+	if h.HasConversation("404") {
+		t.Fatal("HasConversation() = true for unknown conversation")
+	}
+}
+
+func TestHubUnregisterDoesNotDeadlock(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "group", 1, nil)
+
+	// More leavers than the broadcast buffer holds used to wedge the run
+	// loop, because it broadcast the leave notice to itself.
+	const n = 20
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = newClient(nil, strconv.Itoa(i), "user", []string{"1"}, false, nil, nil, nil, nil)
+		drain(clients[i])
+		h.Register <- clients[i]
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, cl := range clients {
+			h.Unregister <- cl
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub deadlocked while unregistering clients")
+	}
+
+	if got := h.Clients("1"); len(got) != 0 {
+		t.Fatalf("Clients() = %v after all clients left", got)
+	}
+}
+
+func TestHubConcurrentRegisterBroadcastUnregister(t *testing.T) {
+	h := newTestHub(t)
+
+	const (
+		rooms      = 5
+		perRoom    = 20
+		broadcasts = 25
+	)
+	for r := 0; r < rooms; r++ {
+		h.OpenConversation(strconv.Itoa(r), "group", 1, nil)
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < rooms; r++ {
+		for i := 0; i < perRoom; i++ {
+			wg.Add(1)
+			go func(room string, id string) {
+				defer wg.Done()
+
+				cl := newClient(nil, id, "user-"+id, []string{room}, false, nil, nil, nil, nil)
+				received := drain(cl)
+				h.Register <- cl
+
+				for j := 0; j < broadcasts; j++ {
+					h.Broadcast <- &Message{
+						ConversationID: room,
+						SenderID:       id,
+						Event:          NewEvent(EventMessageNew, MessagePayload{Content: "hi"}),
+					}
+					// Interleave queries with mutations from other goroutines.
+					_ = h.Clients(room)
+					_ = h.HasConversation(room)
+				}
+
+				h.Unregister <- cl
+				<-received
+			}(strconv.Itoa(r), strconv.Itoa(r*perRoom+i))
+		}
+	}
+
+	// Multiplexed clients subscribe and unsubscribe across every room at once.
+	for i := 0; i < perRoom; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			cl := newClient(nil, id, "mux-"+id, nil, true, nil, nil, nil, nil)
+			received := drain(cl)
+			h.Register <- cl
+			for r := 0; r < rooms; r++ {
+				h.Subscribe <- &Subscription{Client: cl, ConversationID: strconv.Itoa(r)}
+			}
+			for r := 0; r < rooms; r++ {
+				h.Unsubscribe <- &Subscription{Client: cl, ConversationID: strconv.Itoa(r)}
+			}
+			h.Unregister <- cl
+			<-received
+		}("mux" + strconv.Itoa(i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("hub did not finish concurrent workload")
+	}
+
+	for r := 0; r < rooms; r++ {
+		if got := h.Clients(strconv.Itoa(r)); len(got) != 0 {
+			t.Fatalf("room %d still has clients %v", r, got)
+		}
+	}
+}
+
+func TestHubSkipSender(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "group", 1, nil)
+
+	sender := newClient(nil, "1", "sender", []string{"1"}, false, nil, nil, nil, nil)
+	other := newClient(nil, "2", "other", []string{"1"}, false, nil, nil, nil, nil)
+	h.Register <- sender
+	h.Register <- other
+
+	h.Broadcast <- &Message{
+		ConversationID: "1",
+		SenderID:       "1",
+		SkipSender:     true,
+		Event:          NewEvent(EventTyping, TypingPayload{Typing: true}),
+	}
+
+	select {
+	case m := <-other.Message:
+		if m.Event.Type != EventTyping {
+			t.Fatalf("other got %q, want %q", m.Event.Type, EventTyping)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("other client did not receive the event")
+	}
+
+	// Round-trip through the run loop so the broadcast has been processed.
+	_ = h.Clients("1")
+	select {
+	case m := <-sender.Message:
+		t.Fatalf("sender received its own %q event", m.Event.Type)
+	default:
+	}
+}
+
+func TestHubEvictsIdleRooms(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "group", 1, []uint64{1})
+	h.OpenConversation("2", "group", 1, []uint64{1})
+
+	cl := newClient(nil, "1", "user", []string{"2"}, false, nil, nil, nil, nil)
+	drain(cl)
+	h.Register <- cl
+
+	h.do(func() { h.evictIdle(time.Now().Add(2 * roomIdleTTL)) })
+
+	if h.HasConversation("1") {
+		t.Fatal("idle room was not evicted")
+	}
+	if !h.HasConversation("2") {
+		t.Fatal("room with a connected client was evicted")
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "group", 1, nil)
+
+	slow := newClient(nil, "1", "slow", []string{"1"}, false, nil, nil, nil, nil)
+	fast := newClient(nil, "2", "fast", []string{"1"}, false, nil, nil, nil, nil)
+	h.Register <- slow
+	h.Register <- fast
+
+	// fast keeps up in lockstep; slow never reads.
+	const n = sendQueueSize + 10
+	for i := 0; i < n; i++ {
+		h.Broadcast <- &Message{
+			ConversationID: "1",
+			Event:          NewEvent(EventTyping, TypingPayload{Typing: true}),
+		}
+		select {
+		case <-fast.Message:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast client missed event %d", i)
+		}
+	}
+
+	if got := h.Clients("1"); len(got) != 1 || got[0].ID != "2" {
+		t.Fatalf("Clients() = %v, want only the fast client", got)
+	}
+
+	// The slow client's queue is closed after what it had buffered.
+	count := 0
+	for range slow.Message {
+		count++
+	}
+	if count != sendQueueSize {
+		t.Fatalf("slow client got %d events, want %d", count, sendQueueSize)
+	}
+	if slow.closeCode != CloseSlowConsumer {
+		t.Fatalf("close code = %d, want %d", slow.closeCode, CloseSlowConsumer)
+	}
+
+	// Unregistering an evicted client is a no-op.
+	h.Unregister <- slow
+	h.Unregister <- fast
+}
+
+func TestHubRemoveMember(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "group", 1, []uint64{1, 2})
+
+	removed := newClient(nil, "2", "removed", []string{"1"}, false, nil, nil, nil, nil)
+	mux := newClient(nil, "2", "removed", []string{"1"}, true, nil, nil, nil, nil)
+	other := newClient(nil, "1", "other", []string{"1"}, false, nil, nil, nil, nil)
+	h.Register <- removed
+	h.Register <- mux
+	h.Register <- other
+
+	h.RemoveMember(1, 2)
+
+	// The per-conversation socket is closed, the multiplexed one told it
+	// is no longer subscribed.
+	for range removed.Message {
+	}
+	if removed.closeCode != CloseRemoved {
+		t.Fatalf("close code = %d, want %d", removed.closeCode, CloseRemoved)
+	}
+	select {
+	case m := <-mux.Message:
+		if m.Event.Type != EventUnsubscribed {
+			t.Fatalf("multiplexed client got %q, want %q", m.Event.Type, EventUnsubscribed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("multiplexed client was not unsubscribed")
+	}
+
+	if got := h.Clients("1"); len(got) != 1 || got[0].ID != "1" {
+		t.Fatalf("Clients() = %v, want only the remaining member", got)
+	}
+	var member bool
+	h.do(func() { member = h.conversations["1"].Members["2"] })
+	if member {
+		t.Fatal("removed user is still a cached member")
+	}
+
+	// The multiplexed client can no longer target the conversation.
+	if h.Subscribed(mux, "1") {
+		t.Fatal("multiplexed client is still subscribed")
+	}
+	if _, err := mux.conversationFor(h, "1"); err == nil {
+		t.Fatal("conversationFor accepted a conversation the user was removed from")
+	}
+
+	h.Unregister <- removed
+	h.Unregister <- mux
+	h.Unregister <- other
+}
+
+func TestHubChannelDropsQuietEvents(t *testing.T) {
+	h := newTestHub(t)
+	h.OpenConversation("1", "channel", 1, []uint64{1, 2})
+
+	admin := newClient(nil, "1", "admin", []string{"1"}, false, nil, nil, nil, nil)
+	reader := newClient(nil, "2", "reader", []string{"1"}, false, nil, nil, nil, nil)
+	h.Register <- admin
+	h.Register <- reader
+
+	h.broadcast(admin.typingMessage("1", true))
+	h.broadcast(&Message{ConversationID: "1", Event: NewEvent(EventMessageNew, MessagePayload{ConversationID: "1"})})
+
+	select {
+	case m := <-reader.Message:
+		if m.Event.Type != EventMessageNew {
+			t.Fatalf("reader got %q, want %q", m.Event.Type, EventMessageNew)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader did not get the message")
+	}
+
+	h.Unregister <- admin
+	h.Unregister <- reader
+}
+
+func TestHubShutdownClosesClientsWithoutLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	broker := NewMemoryBroker()
+	h := NewHub(broker, nil, nil, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	h.OpenConversation("1", "group", 1, nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := newUpgrader(Config{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		cl := newClient(conn, "1", "user", []string{"1"}, false, nil, nil, nil, nil)
+		if !h.register(cl) {
+			closeGoingAway(conn)
+			return
+		}
+		cl.readMessage(h)
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(h.Clients("1")) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Queued before shutdown, so it must be flushed ahead of the close frame.
+	h.Broadcast <- &Message{ConversationID: "1", Event: NewEvent(EventTyping, TypingPayload{Typing: true})}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ev Event
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatalf("reading event: %v", err)
+	}
+	if ev.Type != EventTyping {
+		t.Fatalf("got %q, want %q", ev.Type, EventTyping)
+	}
+
+	cancel()
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("read after shutdown = %v, want going-away close", err)
+	}
+	if ce := err.(*websocket.CloseError); !strings.Contains(ce.Text, "reconnect") {
+		t.Fatalf("close reason %q lacks a reconnect hint", ce.Text)
+	}
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace + time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	if !h.Closed() {
+		t.Fatal("Closed() = false after shutdown")
+	}
+
+	srv.Close()
+	broker.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
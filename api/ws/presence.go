@@ -0,0 +1,265 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/baohuamap/zchat-api/repository"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+const (
+	// presenceAwayAfter marks a user away when none of their connections
+	// sent a heartbeat for this long.
+	presenceAwayAfter = 2 * time.Minute
+	presenceSweep     = 30 * time.Second
+)
+
+type userPresence struct {
+	conns         int
+	status        string
+	lastHeartbeat time.Time
+}
+
+// Presence derives per-user online/away/offline state from the active
+// WebSocket connections and their heartbeats, and pushes changes to friends.
+// Changes are only marked pending; Run sends each user's current status
+// from one goroutine, so friends never see them out of order.
+type Presence struct {
+	mu    sync.Mutex
+	users map[string]*userPresence
+	// pending users have changed since their status was last sent, which
+	// sent records; absent users were last sent offline. offlineAt is when
+	// a user's last connection closed.
+	pending   map[string]bool
+	sent      map[string]string
+	offlineAt map[string]time.Time
+	wake      chan struct{}
+
+	hub            *Hub
+	userRepo       repository.UserRepository
+	friendshipRepo repository.FriendshipRepository
+}
+
+func NewPresence(h *Hub, user repository.UserRepository, friendship repository.FriendshipRepository) *Presence {
+	return &Presence{
+		users:          make(map[string]*userPresence),
+		pending:        make(map[string]bool),
+		sent:           make(map[string]string),
+		offlineAt:      make(map[string]time.Time),
+		wake:           make(chan struct{}, 1),
+		hub:            h,
+		userRepo:       user,
+		friendshipRepo: friendship,
+	}
+}
+
+// Connect records a new connection for cl's user.
+func (p *Presence) Connect(cl *Client) {
+	p.mu.Lock()
+	u, ok := p.users[cl.ID]
+	if !ok {
+		u = &userPresence{}
+		p.users[cl.ID] = u
+	}
+	u.conns++
+	u.lastHeartbeat = time.Now()
+	if u.status != PresenceOnline {
+		u.status = PresenceOnline
+		delete(p.offlineAt, cl.ID)
+		p.changed(cl.ID)
+	}
+	p.mu.Unlock()
+}
+
+// Heartbeat refreshes cl's user and applies the status the client reported.
+func (p *Presence) Heartbeat(cl *Client, status string) {
+	if status != PresenceAway {
+		status = PresenceOnline
+	}
+
+	p.mu.Lock()
+	u, ok := p.users[cl.ID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	u.lastHeartbeat = time.Now()
+	if u.status != status {
+		u.status = status
+		p.changed(cl.ID)
+	}
+	p.mu.Unlock()
+}
+
+// Disconnect drops a connection; the user goes offline with their last
+// connection and last_seen_at is persisted.
+func (p *Presence) Disconnect(cl *Client) {
+	p.mu.Lock()
+	u, ok := p.users[cl.ID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	u.conns--
+	if u.conns > 0 {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	delete(p.users, cl.ID)
+	p.offlineAt[cl.ID] = now
+	p.changed(cl.ID)
+	p.mu.Unlock()
+
+	go func() {
+		if userID, err := strconv.ParseUint(cl.ID, 10, 64); err == nil {
+			if err := p.userRepo.UpdateLastSeen(context.Background(), userID, now); err != nil {
+				log.Printf("error: %v", err)
+			}
+		}
+	}()
+}
+
+// changed marks userID's status for sending. p.mu must be held.
+func (p *Presence) changed(userID string) {
+	p.pending[userID] = true
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the current presence of userID.
+func (p *Presence) Status(userID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if u, ok := p.users[userID]; ok {
+		return u.status
+	}
+	return PresenceOffline
+}
+
+// Run sends pending status changes and marks users away once their
+// heartbeats stop, until ctx is cancelled.
+func (p *Presence) Run(ctx context.Context) {
+	ticker := time.NewTicker(presenceSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+			p.mu.Lock()
+			for id, u := range p.users {
+				if u.status == PresenceOnline && time.Since(u.lastHeartbeat) > presenceAwayAfter {
+					u.status = PresenceAway
+					p.changed(id)
+				}
+			}
+			p.mu.Unlock()
+		}
+
+		p.flush()
+	}
+}
+
+type presenceChange struct {
+	userID     string
+	status     string
+	lastSeenAt *time.Time
+}
+
+// flush sends the current status of every pending user whose status
+// differs from the one last sent. Changes that cancelled out are dropped.
+func (p *Presence) flush() {
+	var changes []presenceChange
+
+	p.mu.Lock()
+	for id := range p.pending {
+		status := PresenceOffline
+		if u, ok := p.users[id]; ok {
+			status = u.status
+		}
+		last, ok := p.sent[id]
+		if !ok {
+			last = PresenceOffline
+		}
+		if status == last {
+			if status == PresenceOffline {
+				delete(p.offlineAt, id)
+			}
+			continue
+		}
+
+		ch := presenceChange{userID: id, status: status}
+		if status == PresenceOffline {
+			if at, ok := p.offlineAt[id]; ok {
+				ch.lastSeenAt = &at
+			}
+			delete(p.offlineAt, id)
+			delete(p.sent, id)
+		} else {
+			p.sent[id] = status
+		}
+		changes = append(changes, ch)
+	}
+	clear(p.pending)
+	p.mu.Unlock()
+
+	for _, ch := range changes {
+		p.notify(ch.userID, ch.status, ch.lastSeenAt)
+	}
+}
+
+// notify sends a presence event for userID to every connected friend.
+func (p *Presence) notify(userID string, status string, lastSeenAt *time.Time) {
+	id, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if lastSeenAt != nil {
+		u, err := p.userRepo.Get(ctx, id)
+		if err != nil || u.HideLastSeen {
+			lastSeenAt = nil
+		}
+	}
+
+	friendIDs, err := p.friendshipRepo.GetAcceptedFriendIDs(ctx, id)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	if len(friendIDs) == 0 {
+		return
+	}
+
+	recipients := make(map[string]bool, len(friendIDs))
+	for _, f := range friendIDs {
+		recipients[strconv.FormatUint(f, 10)] = true
+	}
+
+	sendOrDone(p.hub.Direct, &DirectMessage{
+		UserIDs: recipients,
+		Message: &Message{
+			Event: NewEvent(EventPresence, PresencePayload{
+				UserID:     userID,
+				Status:     status,
+				LastSeenAt: lastSeenAt,
+			}),
+		},
+	}, p.hub.done)
+}
@@ -0,0 +1,65 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// abuseWindow is the window AbuseThreshold counts rate-limited frames in.
+	abuseWindow = time.Minute
+	// limiterIdleTTL drops the bucket of a user who has not sent anything
+	// for this long; it would be full again anyway.
+	limiterIdleTTL = 10 * time.Minute
+)
+
+// userLimiter holds a token bucket per user, shared by all of the user's
+// connections so opening more sockets does not raise the limit.
+type userLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	users     map[string]*userBucket
+	lastPrune time.Time
+}
+
+type userBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newUserLimiter(cfg Config) *userLimiter {
+	return &userLimiter{
+		limit:     rate.Limit(cfg.RateLimit),
+		burst:     cfg.RateBurst,
+		users:     make(map[string]*userBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes a token from userID's bucket.
+func (l *userLimiter) Allow(userID string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > limiterIdleTTL {
+		for id, b := range l.users {
+			if now.Sub(b.lastSeen) > limiterIdleTTL {
+				delete(l.users, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.users[userID]
+	if !ok {
+		b = &userBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.users[userID] = b
+	}
+	b.lastSeen = now
+	return b.limiter.AllowN(now, 1)
+}
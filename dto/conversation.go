@@ -8,9 +8,9 @@ import (
 
 type CreateConversationReq struct {
 	Type         models.ConversationType `json:"type"` // 1: private, 2: group
-	CreatorID    uint64                  `json:"creator_id"`
 	Participants []uint64                `json:"participants"`
 	Name         string                  `json:"name"`
+	Public       bool                    `json:"public"` // channels only: listed in discovery
 }
 
 type CreateConversationRes struct {
@@ -18,14 +18,27 @@ type CreateConversationRes struct {
 	Type      string `json:"type"` // 1: private, 2: group
 	CreatorID uint64 `json:"creator_id"`
 	Name      string `json:"name"`
+	Public    bool   `json:"public"`
+}
+
+// UpdateConversationReq changes the fields that are set and leaves the
+// others as they are.
+type UpdateConversationReq struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
 }
 
 type ConversationRes struct {
 	ID                        uint64            `json:"id"`
 	Name                      string            `json:"name"`
+	Description               string            `json:"description"`
+	Avatar                    string            `json:"avatar"`
+	Avatars                   AvatarURLs        `json:"avatars"`
 	Type                      string            `json:"type"` // 1: private, 2: group
 	CreatorID                 uint64            `json:"creator_id"`
-	Participants              []ParticipantInfo `json:"participants"`
+	Public                    bool              `json:"public"`
+	Participants              []ParticipantInfo `json:"participants"`     // null for channels
+	SubscriberCount           int64             `json:"subscriber_count"` // channels only
 	Seen                      bool              `json:"seen"`
 	LatestMessageID           uint64            `json:"latest_message_id"`
 	LatestMessageSenderID     uint64            `json:"latest_message_sender_id"`
@@ -33,6 +46,53 @@ type ConversationRes struct {
 	LatestMessageSenderAvatar string            `json:"latest_message_sender_avatar"`
 	LatestMessageContent      string            `json:"latest_message_content"`
 	LatestMessageCreatedAt    time.Time         `json:"latest_message_created_at"`
+	// Settings are the requesting user's own; unset outside of listings.
+	Settings *ConversationSettingsRes `json:"settings,omitempty"`
+}
+
+type ChannelRes struct {
+	ID              uint64     `json:"id"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	Avatar          string     `json:"avatar"`
+	Avatars         AvatarURLs `json:"avatars"`
+	SubscriberCount int64      `json:"subscriber_count"`
+}
+
+type ChannelListRes struct {
+	Channels []ChannelRes `json:"channels"`
+}
+
+// ConversationListFilter narrows a conversation listing. Archived
+// conversations are listed only when Archived is set, and then alone.
+type ConversationListFilter struct {
+	Archived bool
+	Muted    *bool
+	Pinned   *bool
+}
+
+// UpdateConversationSettingsReq changes the fields that are set.
+type UpdateConversationSettingsReq struct {
+	MutedUntil        *time.Time `json:"muted_until"` // mutes until then
+	Unmute            bool       `json:"unmute"`
+	Archived          *bool      `json:"archived"`
+	Pinned            *bool      `json:"pinned"`
+	PinOrder          *int       `json:"pin_order"`          // position among pins, from 1; implies pinned
+	NotificationLevel *string    `json:"notification_level"` // all, mentions or none
+}
+
+type ClearHistoryReq struct {
+	UpToSeq uint64 `json:"up_to_seq"` // 0 clears everything
+}
+
+type ConversationSettingsRes struct {
+	ConversationID    uint64     `json:"conversation_id"`
+	Muted             bool       `json:"muted"`
+	MutedUntil        *time.Time `json:"muted_until"`
+	Archived          bool       `json:"archived"`
+	Pinned            bool       `json:"pinned"`
+	PinOrder          int        `json:"pin_order"`
+	NotificationLevel string     `json:"notification_level"`
 }
 
 type ConversationListRes struct {
@@ -40,13 +100,15 @@ type ConversationListRes struct {
 }
 
 type ParticipantInfo struct {
-	ID        uint64 `json:"id"`
-	Phone     string `json:"phone"`
-	Username  string `json:"username"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
-	Avatar    string `json:"avatar"`
+	ID        uint64     `json:"id"`
+	Phone     string     `json:"phone"`
+	Username  string     `json:"username"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Email     string     `json:"email"`
+	Avatar    string     `json:"avatar"`
+	Avatars   AvatarURLs `json:"avatars"`
+	Role      string     `json:"role"`
 }
 
 type AddParticipantsReq struct {
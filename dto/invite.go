@@ -0,0 +1,36 @@
+package dto
+
+import "time"
+
+type CreateInviteLinkReq struct {
+	ExpiresAt       *time.Time `json:"expires_at"` // omitted never expires
+	MaxUses         int        `json:"max_uses"`   // 0 is unlimited
+	RequireApproval bool       `json:"require_approval"`
+}
+
+type InviteLinkRes struct {
+	ID              uint64     `json:"id"`
+	Token           string     `json:"token"`
+	ConversationID  uint64     `json:"conversation_id"`
+	CreatorID       uint64     `json:"creator_id"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	MaxUses         int        `json:"max_uses"`
+	Uses            int        `json:"uses"`
+	RequireApproval bool       `json:"require_approval"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type JoinByInviteRes struct {
+	ConversationID uint64 `json:"conversation_id"`
+	Status         string `json:"status"` // joined or pending
+}
+
+type JoinRequestRes struct {
+	ID             uint64    `json:"id"`
+	ConversationID uint64    `json:"conversation_id"`
+	UserID         uint64    `json:"user_id"`
+	Username       string    `json:"username"`
+	Avatar         string    `json:"avatar"`
+	InviteLinkID   uint64    `json:"invite_link_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
@@ -1,6 +1,9 @@
 package dto
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Message struct {
 	Content        string `json:"content"`
@@ -9,10 +12,14 @@ type Message struct {
 }
 
 type MessageRes struct {
-	Content        string    `json:"content"`
-	CreateAt       time.Time `json:"createAt"`
-	ConversationID uint64    `json:"conversationId"`
-	SenderID       uint64    `json:"senderId"`
+	ID             uint64     `json:"id"`
+	Seq            uint64     `json:"seq"`
+	Kind           string     `json:"kind"`
+	Content        string     `json:"content"`
+	CreateAt       time.Time  `json:"createAt"`
+	ConversationID uint64     `json:"conversationId"`
+	SenderID       uint64     `json:"senderId"`
+	PinnedAt       *time.Time `json:"pinnedAt,omitempty"`
 }
 
 type MessageListRes struct {
@@ -22,3 +29,23 @@ type MessageListRes struct {
 type SeenMessagesReq struct {
 	UserID uint64 `json:"user_id"`
 }
+
+// SendMessageReq is the body of a message post. The sender is always the
+// authenticated user, never taken from the request.
+type SendMessageReq struct {
+	Content     string `json:"content" binding:"required"`
+	ClientMsgID string `json:"clientMsgId"`
+}
+
+type SendMessageRes struct {
+	ID          uint64    `json:"id"`
+	Seq         uint64    `json:"seq"`
+	ClientMsgID string    `json:"clientMsgId,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type PollRes struct {
+	// Cursor identifies the poll session; pass it to the next poll.
+	Cursor string            `json:"cursor"`
+	Events []json.RawMessage `json:"events"`
+}
@@ -0,0 +1,20 @@
+package dto
+
+import "time"
+
+type PresenceRes struct {
+	UserID     uint64     `json:"user_id"`
+	Status     string     `json:"status"` // online, away, offline
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+type PresenceListRes struct {
+	Friends []PresenceRes `json:"friends"`
+}
+
+// UpdatePrivacyReq changes the settings that are set and leaves the
+// others as they are.
+type UpdatePrivacyReq struct {
+	HideLastSeen   *bool `json:"hide_last_seen"`
+	AllowStrangers *bool `json:"allow_strangers"`
+}
@@ -0,0 +1,25 @@
+package dto
+
+import "time"
+
+type AttachmentRes struct {
+	ID             uint64     `json:"id"`
+	URL            string     `json:"url"`
+	Filename       string     `json:"filename"`
+	ContentType    string     `json:"content_type"`
+	Size           int64      `json:"size"`
+	ConversationID uint64     `json:"conversation_id"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+type ConversationStorageRes struct {
+	ConversationID uint64 `json:"conversation_id"`
+	UsedBytes      int64  `json:"used_bytes"`
+	QuotaBytes     int64  `json:"quota_bytes"`
+}
+
+type StorageUsageRes struct {
+	UsedBytes     int64                    `json:"used_bytes"`
+	QuotaBytes    int64                    `json:"quota_bytes"`
+	Conversations []ConversationStorageRes `json:"conversations"`
+}
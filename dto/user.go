@@ -34,15 +34,16 @@ type LoginUserRes struct {
 }
 
 type FindUserRes struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Phone     string    `json:"phone"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Avatar    string    `json:"avatar"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Phone     string     `json:"phone"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Avatar    string     `json:"avatar"`
+	Avatars   AvatarURLs `json:"avatars"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
 }
 
 type FindUserListRes struct {
@@ -50,32 +51,45 @@ type FindUserListRes struct {
 }
 
 type GetUserRes struct {
-	ID        string `json:"id"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
-	Phone     string `json:"phone"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Avatar    string `json:"avatar"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Phone     string     `json:"phone"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Avatar    string     `json:"avatar"`
+	Avatars   AvatarURLs `json:"avatars"`
+	CreatedAt string     `json:"created_at"`
+	UpdatedAt string     `json:"updated_at"`
+
+	LastSeenAt     *time.Time `json:"last_seen_at"`
+	HideLastSeen   bool       `json:"hide_last_seen"`
+	AllowStrangers bool       `json:"allow_strangers"`
+}
+
+type AvatarURLs struct {
+	Small  string `json:"small"`  // 64px
+	Medium string `json:"medium"` // 256px
+	Large  string `json:"large"`  // 512px
 }
 
 type UploadAvatarRes struct {
-	URL string `json:"url"`
+	URL     string     `json:"url"`
+	Avatars AvatarURLs `json:"avatars"`
 }
 
 type FriendRequestResults struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Phone     string    `json:"phone"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Avatar    string    `json:"avatar"`
-	CreatedAt time.Time `json:"created_at"`
-	Status    string    `json:"status"` // 1: pending, 2: accepted, 3: rejected
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Phone     string     `json:"phone"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Avatar    string     `json:"avatar"`
+	Avatars   AvatarURLs `json:"avatars"`
+	CreatedAt time.Time  `json:"created_at"`
+	Status    string     `json:"status"` // 1: pending, 2: accepted, 3: rejected
 }
 
 type ReceivedFriendRequestsRes struct {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -37,14 +38,7 @@ func main() {
 
 	db := gorm.NewDB()
 
-	dsn := strings.Join([]string{
-		"host=", os.Getenv("PG_HOST"),
-		" port=", os.Getenv("PG_PORT"),
-		" user=", os.Getenv("PG_USER"),
-		" password=", os.Getenv("PG_PASSWORD"),
-		" database=", os.Getenv("PG_NAME"),
-		" sslmode=", os.Getenv("PG_SSLMODE"),
-	}, "")
+	dsn := gorm.DSNFromEnv()
 	if err := db.Connect(dsn); err != nil {
 		slog.Error("Creating connection to DB: ", slog.String("error", err.Error()))
 	}
@@ -66,6 +60,9 @@ func main() {
 	participantRepo := repository.NewParticipantRepository(db.Gormer())
 	conversationRepo := repository.NewConversationRepository(db.Gormer())
 	messageRepo := repository.NewMessageRepository(db.Gormer())
+	attachmentRepo := repository.NewAttachmentRepository(db.Gormer())
+	inviteRepo := repository.NewInviteRepository(db.Gormer())
+	transactor := repository.NewTransactor(db.Gormer())
 
 	s3Client, err := aws.NewS3Client(ctx)
 	if err != nil {
@@ -73,13 +70,52 @@ func main() {
 		os.Exit(1)
 	}
 
-	u := service.NewUserService(userRepo, friendshipRepo, s3Client)
-	m := service.NewMessageService(conversationRepo, messageRepo, participantRepo)
-	httpHandler := httpserver.NewHandler(u, m)
+	var broker ws.Broker
+	switch os.Getenv("HUB_BROKER") {
+	case "postgres":
+		broker, err = ws.NewPostgresBroker(db.DB(), dsn)
+		if err != nil {
+			slog.Error("Creating hub broker: ", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	default:
+		broker = ws.NewMemoryBroker()
+	}
+	defer broker.Close()
 
-	hub := ws.NewHub()
-	wsHandler := ws.NewHandler(hub, conversationRepo, participantRepo, messageRepo)
-	go hub.Run()
+	hub := ws.NewHub(broker, conversationRepo, participantRepo, userRepo, friendshipRepo)
+
+	u := service.NewUserService(userRepo, friendshipRepo, s3Client)
+	m := service.NewMessageService(conversationRepo, messageRepo, participantRepo, hub)
+	st := service.NewStorageService(attachmentRepo, participantRepo, s3Client, service.StorageConfig{
+		UserQuota:         int64(envInt("STORAGE_USER_QUOTA_MB", 1024)) << 20,
+		ConversationQuota: int64(envInt("STORAGE_CONVERSATION_QUOTA_MB", 5120)) << 20,
+		Retention:         time.Duration(envInt("ATTACHMENT_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		SweepInterval:     time.Duration(envInt("ATTACHMENT_SWEEP_INTERVAL_MINUTES", 60)) * time.Minute,
+	})
+	cs := service.NewConversationService(conversationRepo, participantRepo, messageRepo, userRepo, inviteRepo, transactor, s3Client, hub)
+	httpHandler := httpserver.NewHandler(u, m, st, cs)
+
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	go st.RunSweeper(sweeperCtx)
+
+	wsHandler := ws.NewHandler(hub, conversationRepo, participantRepo, messageRepo, userRepo, friendshipRepo, m, ws.Config{
+		Compression:      os.Getenv("WS_COMPRESSION") == "true",
+		CompressionLevel: envInt("WS_COMPRESSION_LEVEL", 0),
+		AllowedOrigins:   envList("WS_ALLOWED_ORIGINS"),
+		MaxMessageSize:   int64(envInt("WS_MAX_MESSAGE_BYTES", 0)),
+		RateLimit:        float64(envInt("WS_RATE_LIMIT", 0)),
+		RateBurst:        envInt("WS_RATE_BURST", 0),
+		AbuseThreshold:   envInt("WS_ABUSE_THRESHOLD", 0),
+	})
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	defer stopHub()
+	hubDone := make(chan struct{})
+	go func() {
+		hub.Run(hubCtx)
+		close(hubDone)
+	}()
 
 	router.SetupRoutes(r, httpHandler, wsHandler)
 
@@ -95,10 +131,38 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	slog.Info("Shutdown Server...")
+	stopSweeper()
+
+	// Hijacked WebSocket connections are not touched by server.Shutdown;
+	// the hub closes them itself.
+	stopHub()
+	<-hubDone
 
-	if err := server.Shutdown(ctx); err != nil {
+	// The startup context has long expired by now; draining gets its own.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(20)*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		slog.Info("Failed to shutdown server: ", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 	slog.Info("Server exiting...")
 }
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envList splits a comma separated variable, dropping empty entries.
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/util"
+)
+
+// AuthUserIDKey is the gin context key holding the authenticated user's ID.
+const AuthUserIDKey = "authUserId"
+
+// AuthUsernameKey is the gin context key holding the authenticated user's name.
+const AuthUsernameKey = "authUsername"
+
+// AuthMiddleware accepts the access token from the "jwt" cookie set at login
+// or from an "Authorization: Bearer" header.
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie("jwt")
+		if err != nil || token == "" {
+			token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing access token"})
+			return
+		}
+
+		claims := &dto.MyJWTClaims{}
+		_, err = jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return []byte(util.JWTSecretKey), nil
+		})
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid access token"})
+			return
+		}
+
+		userID, err := strconv.ParseUint(claims.ID, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid access token"})
+			return
+		}
+
+		c.Set(AuthUserIDKey, userID)
+		c.Set(AuthUsernameKey, claims.Username)
+		c.Next()
+	}
+}
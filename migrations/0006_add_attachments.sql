@@ -0,0 +1,33 @@
+-- Create "attachments" table
+CREATE TABLE "public"."attachments" (
+    "id" bigserial NOT NULL,
+    "created_at" timestamptz NULL,
+    "updated_at" timestamptz NULL,
+    "deleted_at" timestamptz NULL,
+    "key" text NOT NULL,
+    "filename" text NOT NULL,
+    "content_type" text NULL,
+    "size" bigint NOT NULL,
+    "uploader_id" bigint NOT NULL,
+    "conversation_id" bigint NOT NULL,
+    "expires_at" timestamptz NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_attachments_uploader_id" FOREIGN KEY ("uploader_id") REFERENCES "users"("id"),
+    CONSTRAINT "fk_attachments_conversation_id" FOREIGN KEY ("conversation_id") REFERENCES "conversations"("id")
+);
+
+-- Create index "idx_attachments_deleted_at" to table: "attachments"
+CREATE INDEX "idx_attachments_deleted_at" ON "public"."attachments" ("deleted_at");
+
+-- Create index "idx_attachments_uploader_id" to table: "attachments"
+CREATE INDEX "idx_attachments_uploader_id" ON "public"."attachments" ("uploader_id");
+
+-- Create index "idx_attachments_conversation_id" to table: "attachments"
+CREATE INDEX "idx_attachments_conversation_id" ON "public"."attachments" ("conversation_id");
+
+-- Create index "idx_attachments_expires_at" to table: "attachments"
+CREATE INDEX "idx_attachments_expires_at" ON "public"."attachments" ("expires_at");
+
+---- create above / drop below ----
+
+DROP TABLE attachments CASCADE;
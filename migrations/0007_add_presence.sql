@@ -0,0 +1,9 @@
+ALTER TABLE "public"."users"
+ADD COLUMN "last_seen_at" timestamptz DEFAULT NULL,
+ADD COLUMN "hide_last_seen" boolean DEFAULT FALSE;
+
+---- create above / drop below ----
+
+ALTER TABLE "public"."users"
+DROP COLUMN "last_seen_at",
+DROP COLUMN "hide_last_seen";
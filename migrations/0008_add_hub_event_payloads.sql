@@ -0,0 +1,14 @@
+-- Create "hub_event_payloads" table holding hub messages too large for NOTIFY
+CREATE UNLOGGED TABLE "public"."hub_event_payloads" (
+    "id" bigserial NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "payload" text NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+-- Create index "idx_hub_event_payloads_created_at" to table: "hub_event_payloads"
+CREATE INDEX "idx_hub_event_payloads_created_at" ON "public"."hub_event_payloads" ("created_at");
+
+---- create above / drop below ----
+
+DROP TABLE hub_event_payloads CASCADE;
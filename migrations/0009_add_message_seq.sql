@@ -0,0 +1,34 @@
+ALTER TABLE "public"."conversations"
+ADD COLUMN "last_seq" bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE "public"."messages"
+ADD COLUMN "seq" bigint NOT NULL DEFAULT 0;
+
+UPDATE "public"."messages" m
+SET "seq" = s."seq"
+FROM (
+    SELECT "id", ROW_NUMBER() OVER (PARTITION BY "conversation_id" ORDER BY "created_at", "id") AS "seq"
+    FROM "public"."messages"
+) s
+WHERE m."id" = s."id";
+
+UPDATE "public"."conversations" c
+SET "last_seq" = m."last_seq"
+FROM (
+    SELECT "conversation_id", MAX("seq") AS "last_seq"
+    FROM "public"."messages"
+    GROUP BY "conversation_id"
+) m
+WHERE c."id" = m."conversation_id";
+
+CREATE UNIQUE INDEX "messages_conversation_id_seq_idx" ON "public"."messages" ("conversation_id", "seq");
+
+---- create above / drop below ----
+
+DROP INDEX IF EXISTS "messages_conversation_id_seq_idx";
+
+ALTER TABLE "public"."messages"
+DROP COLUMN "seq";
+
+ALTER TABLE "public"."conversations"
+DROP COLUMN "last_seq";
@@ -0,0 +1,12 @@
+ALTER TABLE "public"."messages"
+ADD COLUMN "client_msg_id" uuid DEFAULT NULL;
+
+CREATE UNIQUE INDEX "messages_sender_id_client_msg_id_idx" ON "public"."messages" ("sender_id", "client_msg_id")
+WHERE "client_msg_id" IS NOT NULL;
+
+---- create above / drop below ----
+
+DROP INDEX IF EXISTS "messages_sender_id_client_msg_id_idx";
+
+ALTER TABLE "public"."messages"
+DROP COLUMN "client_msg_id";
@@ -0,0 +1,23 @@
+CREATE TYPE "participant_role" AS ENUM ('owner', 'admin', 'member');
+
+ALTER TABLE "public"."participants"
+ADD COLUMN "role" "participant_role" NOT NULL DEFAULT 'member';
+
+-- Group creators become their owners.
+UPDATE "public"."participants" p
+SET "role" = 'owner'
+FROM "public"."conversations" c
+WHERE p."conversation_id" = c."id" AND p."user_id" = c."creator_id" AND c."type" = 'group';
+
+ALTER TABLE "public"."messages"
+ADD COLUMN "kind" text NOT NULL DEFAULT 'text';
+
+---- create above / drop below ----
+
+ALTER TABLE "public"."messages"
+DROP COLUMN "kind";
+
+ALTER TABLE "public"."participants"
+DROP COLUMN "role";
+
+DROP TYPE "participant_role";
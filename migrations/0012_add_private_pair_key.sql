@@ -0,0 +1,36 @@
+ALTER TABLE "public"."users"
+ADD COLUMN "allow_strangers" boolean DEFAULT FALSE;
+
+ALTER TABLE "public"."conversations"
+ADD COLUMN "pair_key" text DEFAULT NULL;
+
+-- Existing private conversations keep their pair; where a pair already has
+-- several, the oldest one becomes the canonical thread.
+UPDATE "public"."conversations" c
+SET "pair_key" = pairs."pair_key"
+FROM (
+    SELECT DISTINCT ON ("pair_key") "conversation_id", "pair_key"
+    FROM (
+        SELECT p."conversation_id", MIN(p."user_id") || ':' || MAX(p."user_id") AS "pair_key"
+        FROM "public"."participants" p
+        JOIN "public"."conversations" pc ON pc."id" = p."conversation_id"
+        WHERE pc."type" = 'private' AND p."deleted_at" IS NULL
+        GROUP BY p."conversation_id"
+        HAVING COUNT(DISTINCT p."user_id") = 2
+    ) keyed
+    ORDER BY "pair_key", "conversation_id"
+) pairs
+WHERE c."id" = pairs."conversation_id";
+
+-- Create index "idx_conversations_pair_key" to table: "conversations"
+CREATE UNIQUE INDEX "idx_conversations_pair_key" ON "public"."conversations" ("pair_key");
+
+---- create above / drop below ----
+
+DROP INDEX "public"."idx_conversations_pair_key";
+
+ALTER TABLE "public"."conversations"
+DROP COLUMN "pair_key";
+
+ALTER TABLE "public"."users"
+DROP COLUMN "allow_strangers";
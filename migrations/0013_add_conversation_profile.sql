@@ -0,0 +1,17 @@
+ALTER TABLE "public"."conversations"
+ADD COLUMN "description" text DEFAULT NULL,
+ADD COLUMN "avatar" text DEFAULT NULL,
+ADD COLUMN "avatar_small" text DEFAULT NULL,
+ADD COLUMN "avatar_medium" text DEFAULT NULL,
+ADD COLUMN "avatar_large" text DEFAULT NULL,
+ADD COLUMN "avatar_key" text DEFAULT NULL;
+
+---- create above / drop below ----
+
+ALTER TABLE "public"."conversations"
+DROP COLUMN "description",
+DROP COLUMN "avatar",
+DROP COLUMN "avatar_small",
+DROP COLUMN "avatar_medium",
+DROP COLUMN "avatar_large",
+DROP COLUMN "avatar_key";
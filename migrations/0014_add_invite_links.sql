@@ -0,0 +1,55 @@
+-- Create "invite_links" table
+CREATE TABLE "public"."invite_links" (
+    "id" bigserial NOT NULL,
+    "created_at" timestamptz NULL,
+    "updated_at" timestamptz NULL,
+    "deleted_at" timestamptz NULL,
+    "token" text NOT NULL,
+    "conversation_id" bigint NOT NULL,
+    "creator_id" bigint NOT NULL,
+    "expires_at" timestamptz NULL,
+    "max_uses" bigint NOT NULL DEFAULT 0,
+    "uses" bigint NOT NULL DEFAULT 0,
+    "require_approval" boolean NOT NULL DEFAULT FALSE,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_invite_links_conversation_id" FOREIGN KEY ("conversation_id") REFERENCES "conversations"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT "fk_invite_links_creator_id" FOREIGN KEY ("creator_id") REFERENCES "users"("id")
+);
+
+-- Create index "idx_invite_links_token" to table: "invite_links"
+CREATE UNIQUE INDEX "idx_invite_links_token" ON "public"."invite_links" ("token");
+
+-- Create index "idx_invite_links_deleted_at" to table: "invite_links"
+CREATE INDEX "idx_invite_links_deleted_at" ON "public"."invite_links" ("deleted_at");
+
+-- Create index "idx_invite_links_conversation_id" to table: "invite_links"
+CREATE INDEX "idx_invite_links_conversation_id" ON "public"."invite_links" ("conversation_id");
+
+-- Create "join_requests" table
+CREATE TABLE "public"."join_requests" (
+    "id" bigserial NOT NULL,
+    "created_at" timestamptz NULL,
+    "updated_at" timestamptz NULL,
+    "deleted_at" timestamptz NULL,
+    "conversation_id" bigint NOT NULL,
+    "user_id" bigint NOT NULL,
+    "invite_link_id" bigint NOT NULL,
+    "status" text NOT NULL DEFAULT 'pending',
+    "decided_by" bigint NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_join_requests_conversation_id" FOREIGN KEY ("conversation_id") REFERENCES "conversations"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT "fk_join_requests_user_id" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT "fk_join_requests_invite_link_id" FOREIGN KEY ("invite_link_id") REFERENCES "invite_links"("id")
+);
+
+-- Create index "idx_join_requests_deleted_at" to table: "join_requests"
+CREATE INDEX "idx_join_requests_deleted_at" ON "public"."join_requests" ("deleted_at");
+
+-- A user has at most one pending request per conversation.
+CREATE UNIQUE INDEX "idx_join_requests_pending" ON "public"."join_requests" ("conversation_id", "user_id") WHERE "status" = 'pending';
+
+---- create above / drop below ----
+
+DROP TABLE join_requests CASCADE;
+
+DROP TABLE invite_links CASCADE;
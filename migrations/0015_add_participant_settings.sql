@@ -0,0 +1,13 @@
+ALTER TABLE "public"."participants"
+ADD COLUMN "muted_until" timestamptz DEFAULT NULL,
+ADD COLUMN "archived" boolean NOT NULL DEFAULT FALSE,
+ADD COLUMN "pin_order" bigint NOT NULL DEFAULT 0,
+ADD COLUMN "notification_level" text NOT NULL DEFAULT 'all';
+
+---- create above / drop below ----
+
+ALTER TABLE "public"."participants"
+DROP COLUMN "muted_until",
+DROP COLUMN "archived",
+DROP COLUMN "pin_order",
+DROP COLUMN "notification_level";
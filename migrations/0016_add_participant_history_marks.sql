@@ -0,0 +1,9 @@
+ALTER TABLE "public"."participants"
+ADD COLUMN "cleared_seq" bigint NOT NULL DEFAULT 0,
+ADD COLUMN "unhide_seq" bigint NOT NULL DEFAULT 0;
+
+---- create above / drop below ----
+
+ALTER TABLE "public"."participants"
+DROP COLUMN "cleared_seq",
+DROP COLUMN "unhide_seq";
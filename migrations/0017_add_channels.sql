@@ -0,0 +1,31 @@
+ALTER TYPE "conversation_type" ADD VALUE IF NOT EXISTS 'channel';
+
+-- Public channels are listed in discovery and open to anyone to subscribe.
+ALTER TABLE "public"."conversations"
+ADD COLUMN "public" boolean NOT NULL DEFAULT FALSE;
+
+-- Create index "idx_conversations_public" to table: "conversations"
+CREATE INDEX "idx_conversations_public" ON "public"."conversations" ("public") WHERE "public";
+
+-- Subscriber counts and membership lookups of large channels.
+-- Create index "idx_participants_conversation_id" to table: "participants"
+CREATE INDEX "idx_participants_conversation_id" ON "public"."participants" ("conversation_id") WHERE "deleted_at" IS NULL;
+
+---- create above / drop below ----
+
+DROP INDEX "public"."idx_participants_conversation_id";
+
+DROP INDEX "public"."idx_conversations_public";
+
+ALTER TABLE "public"."conversations"
+DROP COLUMN "public";
+
+-- Postgres cannot drop an enum value; channels must be removed before
+-- 'channel' stops being used, and the value itself stays. Participants,
+-- messages and attachments do not cascade, so they go first.
+DELETE FROM "public"."join_requests" WHERE "conversation_id" IN (SELECT "id" FROM "public"."conversations" WHERE "type" = 'channel');
+DELETE FROM "public"."invite_links" WHERE "conversation_id" IN (SELECT "id" FROM "public"."conversations" WHERE "type" = 'channel');
+DELETE FROM "public"."attachments" WHERE "conversation_id" IN (SELECT "id" FROM "public"."conversations" WHERE "type" = 'channel');
+DELETE FROM "public"."messages" WHERE "conversation_id" IN (SELECT "id" FROM "public"."conversations" WHERE "type" = 'channel');
+DELETE FROM "public"."participants" WHERE "conversation_id" IN (SELECT "id" FROM "public"."conversations" WHERE "type" = 'channel');
+DELETE FROM "public"."conversations" WHERE "type" = 'channel';
@@ -0,0 +1,35 @@
+-- Groups created without their creator among the participants were left
+-- without an owner by 0011. Creators who never took part become owners.
+INSERT INTO "public"."participants" ("created_at", "updated_at", "user_id", "conversation_id", "role")
+SELECT c."created_at", NOW(), c."creator_id", c."id", 'owner'
+FROM "public"."conversations" c
+WHERE c."type" = 'group' AND c."deleted_at" IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM "public"."participants" p
+    WHERE p."conversation_id" = c."id" AND p."role" = 'owner' AND p."deleted_at" IS NULL
+)
+AND NOT EXISTS (
+    SELECT 1 FROM "public"."participants" p
+    WHERE p."conversation_id" = c."id" AND p."user_id" = c."creator_id"
+);
+
+-- Any group still without an owner passes ownership on as leaving does:
+-- to the highest ranked, longest standing participant.
+UPDATE "public"."participants" p
+SET "role" = 'owner', "updated_at" = NOW()
+FROM (
+    SELECT DISTINCT ON (p."conversation_id") p."id"
+    FROM "public"."participants" p
+    JOIN "public"."conversations" c ON c."id" = p."conversation_id"
+    WHERE c."type" = 'group' AND c."deleted_at" IS NULL AND p."deleted_at" IS NULL
+    AND NOT EXISTS (
+        SELECT 1 FROM "public"."participants" o
+        WHERE o."conversation_id" = p."conversation_id" AND o."role" = 'owner' AND o."deleted_at" IS NULL
+    )
+    ORDER BY p."conversation_id", p."role", p."created_at"
+) successor
+WHERE p."id" = successor."id";
+
+---- create above / drop below ----
+
+-- The owners assigned above are kept.
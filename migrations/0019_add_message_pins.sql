@@ -0,0 +1,16 @@
+ALTER TABLE "public"."messages"
+ADD COLUMN "pinned_at" timestamptz DEFAULT NULL,
+ADD COLUMN "pinned_by_id" bigint DEFAULT NULL,
+ADD CONSTRAINT "fk_messages_pinned_by_id" FOREIGN KEY ("pinned_by_id") REFERENCES "users"("id");
+
+-- Create index "idx_messages_pinned" to table: "messages"
+CREATE INDEX "idx_messages_pinned" ON "public"."messages" ("conversation_id") WHERE "pinned_at" IS NOT NULL;
+
+---- create above / drop below ----
+
+DROP INDEX "public"."idx_messages_pinned";
+
+ALTER TABLE "public"."messages"
+DROP CONSTRAINT "fk_messages_pinned_by_id",
+DROP COLUMN "pinned_at",
+DROP COLUMN "pinned_by_id";
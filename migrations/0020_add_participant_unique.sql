@@ -0,0 +1,17 @@
+-- Concurrent joins could add a user to a conversation twice. Keep the
+-- highest ranked, oldest of each user's active participations.
+UPDATE "public"."participants" p
+SET "deleted_at" = NOW()
+FROM (
+    SELECT "id", ROW_NUMBER() OVER (PARTITION BY "user_id", "conversation_id" ORDER BY "role", "created_at", "id") AS "n"
+    FROM "public"."participants"
+    WHERE "deleted_at" IS NULL
+) d
+WHERE p."id" = d."id" AND d."n" > 1;
+
+-- Create index "idx_participants_active" to table: "participants"
+CREATE UNIQUE INDEX "idx_participants_active" ON "public"."participants" ("user_id", "conversation_id") WHERE "deleted_at" IS NULL;
+
+---- create above / drop below ----
+
+DROP INDEX "public"."idx_participants_active";
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Attachment struct {
+	gorm.Model
+	ID             uint64       `gorm:"primaryKey" autoIncrement:"true" json:"id"`
+	Key            string       `gorm:"not null" json:"key"` // S3 object key
+	Filename       string       `gorm:"not null" json:"filename"`
+	ContentType    string       `json:"content_type"`
+	Size           int64        `gorm:"not null" json:"size"` // bytes
+	UploaderID     uint64       `gorm:"not null" json:"uploader_id"`
+	Uploader       User         `gorm:"foreignKey:UploaderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"uploader"`
+	ConversationID uint64       `gorm:"not null" json:"conversation_id"`
+	Conversation   Conversation `gorm:"foreignKey:ConversationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"conversation"`
+	ExpiresAt      *time.Time   `json:"expires_at"` // nil keeps the attachment forever
+}
@@ -4,12 +4,26 @@ import "gorm.io/gorm"
 
 type Conversation struct {
 	gorm.Model
-	ID        uint64           `gorm:"primaryKey autoIncrement:true" json:"id"`
-	Name      string           `gorm:"null" json:"name"`                            // Name of the conversation
-	Type      ConversationType `gorm:"type:conversation_type;not null" json:"type"` // Enum: 'private', 'group'
-	CreatorID uint64           `gorm:"null" json:"creator_id"`
-	Creator   User             `gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"creator"`
-	Seen      bool             `gorm:"default:false" json:"seen"`
+	ID          uint64           `gorm:"primaryKey autoIncrement:true" json:"id"`
+	Name        string           `gorm:"null" json:"name"` // Name of the conversation
+	Description string           `gorm:"null" json:"description"`
+	Type        ConversationType `gorm:"type:conversation_type;not null" json:"type"` // Enum: 'private', 'group', 'channel'
+	CreatorID   uint64           `gorm:"null" json:"creator_id"`
+	Creator     User             `gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"creator"`
+	Seen        bool             `gorm:"default:false" json:"seen"`
+	LastSeq     uint64           `gorm:"not null;default:0" json:"-"` // Seq of the latest message
+	// PairKey is "<lower user ID>:<higher user ID>" for private
+	// conversations and unique, so each pair of users has at most one.
+	PairKey *string `gorm:"uniqueIndex" json:"-"`
+	// Public channels can be discovered and subscribed to by anyone.
+	Public bool `gorm:"not null;default:false" json:"public"`
+
+	// Group avatar variants; AvatarKey is the content-hashed S3 key prefix they share.
+	Avatar       string `json:"avatar"`
+	AvatarSmall  string `json:"avatar_small"`
+	AvatarMedium string `json:"avatar_medium"`
+	AvatarLarge  string `json:"avatar_large"`
+	AvatarKey    string `json:"-"`
 }
 
 type ConversationType string
@@ -17,4 +31,7 @@ type ConversationType string
 const (
 	ConversationTypePrivate ConversationType = "private"
 	ConversationTypeGroup   ConversationType = "group"
+	// ConversationTypeChannel is a broadcast conversation: admins post and
+	// any number of subscribers, who are members, read.
+	ConversationTypeChannel ConversationType = "channel"
 )
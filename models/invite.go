@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InviteLink lets anyone holding its token join a group conversation.
+// Revoked links are soft-deleted.
+type InviteLink struct {
+	gorm.Model
+	ID              uint64       `gorm:"primaryKey" autoIncrement:"true" json:"id"`
+	Token           string       `gorm:"not null;uniqueIndex" json:"token"`
+	ConversationID  uint64       `gorm:"not null" json:"conversation_id"`
+	Conversation    Conversation `gorm:"foreignKey:ConversationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"conversation"`
+	CreatorID       uint64       `gorm:"not null" json:"creator_id"`
+	ExpiresAt       *time.Time   `json:"expires_at"`                         // nil never expires
+	MaxUses         int          `gorm:"not null;default:0" json:"max_uses"` // 0 is unlimited
+	Uses            int          `gorm:"not null;default:0" json:"uses"`     // participants who joined through the link
+	RequireApproval bool         `gorm:"not null;default:false" json:"require_approval"`
+}
+
+// JoinRequest is a user waiting for an admin to let them in through an
+// invite link that requires approval.
+type JoinRequest struct {
+	gorm.Model
+	ID             uint64            `gorm:"primaryKey" autoIncrement:"true" json:"id"`
+	ConversationID uint64            `gorm:"not null" json:"conversation_id"`
+	UserID         uint64            `gorm:"not null" json:"user_id"`
+	User           User              `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"user"`
+	InviteLinkID   uint64            `gorm:"not null" json:"invite_link_id"`
+	Status         JoinRequestStatus `gorm:"not null;default:pending" json:"status"`
+	DecidedBy      *uint64           `json:"decided_by"`
+}
+
+type JoinRequestStatus string
+
+const (
+	JoinRequestPending  JoinRequestStatus = "pending"
+	JoinRequestApproved JoinRequestStatus = "approved"
+	JoinRequestRejected JoinRequestStatus = "rejected"
+)
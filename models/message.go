@@ -1,13 +1,32 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Message struct {
 	gorm.Model
 	ID             uint64       `gorm:"primaryKey" autoIncrement:"true" json:"id"`
 	Content        string       `gorm:"not null" json:"content"`
+	Seq            uint64       `gorm:"not null;default:0" json:"seq"`  // Per-conversation order, starting at 1
+	ClientMsgID    *string      `gorm:"type:uuid" json:"client_msg_id"` // Sender-generated, unique per sender
+	Kind           MessageKind  `gorm:"not null;default:text" json:"kind"`
 	ConversationID uint64       `gorm:"not null" json:"conversation_id"`
 	Conversation   Conversation `gorm:"foreignKey:ConversationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"conversation"`
 	SenderID       uint64       `gorm:"not null" json:"sender_id"`
 	Sender         User         `gorm:"foreignKey:SenderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"sender"`
+	PinnedAt       *time.Time   `json:"pinned_at"` // nil unless pinned
+	PinnedByID     *uint64      `json:"pinned_by_id"`
 }
+
+type MessageKind string
+
+const (
+	MessageKindText MessageKind = "text"
+	// MessageKindSystem messages record conversation changes, such as
+	// members joining or roles changing. SenderID is the user who made
+	// the change.
+	MessageKindSystem MessageKind = "system"
+)
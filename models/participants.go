@@ -1,12 +1,56 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Participant struct {
 	gorm.Model
-	ID             uint64       `gorm:"primaryKey" autoIncrement:"true" json:"id"`
-	UserID         uint64       `gorm:"not null" json:"user_id"`
-	User           User         `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"user"`
-	ConversationID uint64       `gorm:"not null" json:"conversation_id"`
-	Conversation   Conversation `gorm:"foreignKey:ConversationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"conversation"`
+	ID             uint64          `gorm:"primaryKey" autoIncrement:"true" json:"id"`
+	UserID         uint64          `gorm:"not null;uniqueIndex:idx_participants_active,where:deleted_at IS NULL" json:"user_id"`
+	User           User            `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"user"`
+	ConversationID uint64          `gorm:"not null;uniqueIndex:idx_participants_active,where:deleted_at IS NULL" json:"conversation_id"`
+	Conversation   Conversation    `gorm:"foreignKey:ConversationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"conversation"`
+	Role           ParticipantRole `gorm:"type:participant_role;not null;default:member" json:"role"`
+
+	// Settings of the conversation for this participant only.
+	MutedUntil        *time.Time        `json:"muted_until"` // nil is not muted
+	Archived          bool              `gorm:"not null;default:false" json:"archived"`
+	PinOrder          int               `gorm:"not null;default:0" json:"pin_order"` // 0 is unpinned; pins sort ascending
+	NotificationLevel NotificationLevel `gorm:"not null;default:all" json:"notification_level"`
+	// ClearedSeq hides messages up to it from this participant's history.
+	ClearedSeq uint64 `gorm:"not null;default:0" json:"cleared_seq"`
+	// UnhideSeq hides the conversation from this participant's list until
+	// the message with this seq arrives; 0 is not hidden.
+	UnhideSeq uint64 `gorm:"not null;default:0" json:"unhide_seq"`
+}
+
+// Hidden reports whether the participant has hidden a conversation whose
+// latest message is lastSeq.
+func (p *Participant) Hidden(lastSeq uint64) bool {
+	return lastSeq < p.UnhideSeq
+}
+
+// Muted reports whether the participant has muted the conversation at now.
+func (p *Participant) Muted(now time.Time) bool {
+	return p.MutedUntil != nil && now.Before(*p.MutedUntil)
 }
+
+type ParticipantRole string
+
+const (
+	ParticipantRoleOwner  ParticipantRole = "owner"
+	ParticipantRoleAdmin  ParticipantRole = "admin"
+	ParticipantRoleMember ParticipantRole = "member"
+)
+
+// NotificationLevel is which messages of a conversation notify a participant.
+type NotificationLevel string
+
+const (
+	NotificationLevelAll      NotificationLevel = "all"
+	NotificationLevelMentions NotificationLevel = "mentions"
+	NotificationLevelNone     NotificationLevel = "none"
+)
@@ -1,6 +1,10 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	gorm.Model
@@ -12,4 +16,15 @@ type User struct {
 	LastName  string `json:"last_name"`
 	Avatar    string `json:"avatar"`
 	Phone     string `json:"phone" gorm:"unique"`
+
+	// Processed avatar variants; AvatarKey is the content-hashed S3 key prefix they share.
+	AvatarSmall  string `json:"avatar_small"`
+	AvatarMedium string `json:"avatar_medium"`
+	AvatarLarge  string `json:"avatar_large"`
+	AvatarKey    string `json:"-"`
+
+	LastSeenAt   *time.Time `json:"last_seen_at"`
+	HideLastSeen bool       `gorm:"default:false" json:"hide_last_seen"` // privacy: hide last_seen_at from others
+	// privacy: let users who are not friends start a private conversation
+	AllowStrangers bool `gorm:"default:false" json:"allow_strangers"`
 }
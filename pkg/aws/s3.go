@@ -3,6 +3,7 @@ package aws
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"mime/multipart"
 	"path/filepath"
@@ -18,6 +19,8 @@ import (
 type S3Client interface {
 	getBucketName() string
 	UploadFile(ctx context.Context, key string, file *multipart.File) error
+	PutObject(ctx context.Context, key string, body io.Reader, contentType string) error
+	DeleteFile(ctx context.Context, key string) error
 	GetFileURL(key string) string
 }
 
@@ -73,6 +76,32 @@ func (s *s3Client) UploadFile(ctx context.Context, key string, file *multipart.F
 	return err
 }
 
+func (s *s3Client) PutObject(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.getBucketName()),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		log.Printf("Couldn't upload object %v:%v. Here's why: %v\n", s.getBucketName(), key, err)
+	}
+
+	return err
+}
+
+func (s *s3Client) DeleteFile(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.getBucketName()),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Couldn't delete object %v:%v. Here's why: %v\n", s.getBucketName(), key, err)
+	}
+
+	return err
+}
+
 func mimeTypeByExtension(filename string) string {
 	ext := filepath.Ext(filename)
 	switch ext {
@@ -82,6 +111,8 @@ func mimeTypeByExtension(filename string) string {
 		return "image/jpeg"
 	case ".gif":
 		return "image/gif"
+	case ".webp":
+		return "image/webp"
 	default:
 		return "application/octet-stream"
 	}
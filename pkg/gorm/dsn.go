@@ -0,0 +1,19 @@
+package gorm
+
+import (
+	"os"
+	"strings"
+)
+
+// DSNFromEnv builds the Postgres connection string from the PG_* variables.
+// It is shared by the gorm connection and any raw listeners on the same DB.
+func DSNFromEnv() string {
+	return strings.Join([]string{
+		"host=", os.Getenv("PG_HOST"),
+		" port=", os.Getenv("PG_PORT"),
+		" user=", os.Getenv("PG_USER"),
+		" password=", os.Getenv("PG_PASSWORD"),
+		" database=", os.Getenv("PG_NAME"),
+		" sslmode=", os.Getenv("PG_SSLMODE"),
+	}, "")
+}
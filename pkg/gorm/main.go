@@ -34,6 +34,8 @@ func NewDB() DBAdapter {
 func (db *adapter) Connect(dsn string) error {
 	gormer, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
 		DisableForeignKeyConstraintWhenMigrating: false,
+		// Report unique violations as gorm.ErrDuplicatedKey.
+		TranslateError: true,
 	})
 
 	if err != nil {
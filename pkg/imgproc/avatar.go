@@ -0,0 +1,130 @@
+package imgproc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	// Register the formats accepted for avatar uploads.
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxUploadSize is the largest avatar payload accepted before decoding.
+	MaxUploadSize = 10 << 20
+	// MaxDimension bounds width and height to guard against decompression bombs.
+	MaxDimension = 8000
+	// MinDimension is the smallest edge we are willing to upscale from.
+	MinDimension = 32
+
+	jpegQuality = 85
+)
+
+var (
+	ErrTooLarge          = errors.New("image is too large")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrInvalidDimensions = errors.New("invalid image dimensions")
+)
+
+var supportedFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+	"webp": true,
+}
+
+// Variant is one encoded size of a processed image.
+type Variant struct {
+	Size        int
+	Data        []byte
+	ContentType string
+}
+
+// Decode reads and validates an uploaded image. Only the decoded pixels are
+// kept, so any EXIF or other metadata in the source is dropped.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	if !supportedFormats[format] {
+		return nil, ErrUnsupportedFormat
+	}
+	if cfg.Width < MinDimension || cfg.Height < MinDimension ||
+		cfg.Width > MaxDimension || cfg.Height > MaxDimension {
+		return nil, ErrInvalidDimensions
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+
+	return img, nil
+}
+
+// CenterCrop returns the largest centered square of img.
+func CenterCrop(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	rect := image.Rect(x0, y0, x0+side, y0+side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Copy(dst, image.Point{}, img, rect, draw.Src, nil)
+	return dst
+}
+
+// Resize scales img to a size x size square.
+func Resize(img image.Image, size int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// Flatten composites img onto white. JPEG has no alpha channel, so
+// transparent pixels would otherwise come out black.
+func Flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// Avatar center-crops img and encodes one JPEG variant per requested size.
+func Avatar(img image.Image, sizes []int) ([]Variant, error) {
+	square := Flatten(CenterCrop(img))
+
+	variants := make([]Variant, 0, len(sizes))
+	for _, size := range sizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, Resize(square, size), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{
+			Size:        size,
+			Data:        buf.Bytes(),
+			ContentType: "image/jpeg",
+		})
+	}
+
+	return variants, nil
+}
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/baohuamap/zchat-api/models"
+	"gorm.io/gorm"
+)
+
+type ConversationUsage struct {
+	ConversationID uint64
+	Size           int64
+}
+
+type AttachmentRepository interface {
+	Create(ctx context.Context, attachment *models.Attachment) error
+	CreateWithinQuota(ctx context.Context, attachment *models.Attachment, userQuota, conversationQuota int64) (bool, error)
+	Get(ctx context.Context, id uint64) (*models.Attachment, error)
+	SumSizeByUploaderID(ctx context.Context, uploaderID uint64) (int64, error)
+	SumSizeByConversationID(ctx context.Context, conversationID uint64) (int64, error)
+	SumSizeByUploaderIDGroupByConversation(ctx context.Context, uploaderID uint64) ([]ConversationUsage, error)
+	GetExpired(ctx context.Context, now time.Time, limit int) ([]models.Attachment, error)
+	GetOrphaned(ctx context.Context, limit int) ([]models.Attachment, error)
+	Delete(ctx context.Context, id uint64) error
+}
+
+type attachment struct {
+	DB *gorm.DB
+}
+
+func NewAttachmentRepository(DB *gorm.DB) AttachmentRepository {
+	return &attachment{DB: DB}
+}
+
+func (r attachment) Create(ctx context.Context, attachment *models.Attachment) error {
+	return r.DB.Create(&attachment).Error
+}
+
+// CreateWithinQuota inserts a unless it would take its uploader
+// or conversation over quota, reporting whether it did. A zero quota is
+// unlimited. The uploader and conversation rows are locked, in that order,
+// so concurrent uploads are checked one after another.
+func (r attachment) CreateWithinQuota(ctx context.Context, a *models.Attachment, userQuota, conversationQuota int64) (bool, error) {
+	created := false
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT 1 FROM users WHERE id = ? FOR UPDATE", a.UploaderID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("SELECT 1 FROM conversations WHERE id = ? FOR UPDATE", a.ConversationID).Error; err != nil {
+			return err
+		}
+
+		used := attachment{DB: tx}
+		if userQuota > 0 {
+			total, err := used.SumSizeByUploaderID(ctx, a.UploaderID)
+			if err != nil {
+				return err
+			}
+			if total+a.Size > userQuota {
+				return nil
+			}
+		}
+		if conversationQuota > 0 {
+			total, err := used.SumSizeByConversationID(ctx, a.ConversationID)
+			if err != nil {
+				return err
+			}
+			if total+a.Size > conversationQuota {
+				return nil
+			}
+		}
+
+		if err := tx.Create(a).Error; err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+func (r attachment) Get(ctx context.Context, id uint64) (*models.Attachment, error) {
+	var a models.Attachment
+	err := r.DB.First(&a, id).Error
+	return &a, err
+}
+
+func (r attachment) SumSizeByUploaderID(ctx context.Context, uploaderID uint64) (int64, error) {
+	var total int64
+	err := r.DB.Model(&models.Attachment{}).
+		Where("uploader_id = ?", uploaderID).
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&total).Error
+	return total, err
+}
+
+func (r attachment) SumSizeByConversationID(ctx context.Context, conversationID uint64) (int64, error) {
+	var total int64
+	err := r.DB.Model(&models.Attachment{}).
+		Where("conversation_id = ?", conversationID).
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&total).Error
+	return total, err
+}
+
+func (r attachment) SumSizeByUploaderIDGroupByConversation(ctx context.Context, uploaderID uint64) ([]ConversationUsage, error) {
+	var usage []ConversationUsage
+	err := r.DB.Model(&models.Attachment{}).
+		Select("conversation_id, SUM(size) AS size").
+		Where("uploader_id = ?", uploaderID).
+		Group("conversation_id").
+		Order("conversation_id").
+		Scan(&usage).Error
+	return usage, err
+}
+
+func (r attachment) GetExpired(ctx context.Context, now time.Time, limit int) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+	err := r.DB.Where("expires_at IS NOT NULL AND expires_at < ?", now).
+		Limit(limit).
+		Find(&attachments).Error
+	return attachments, err
+}
+
+// GetOrphaned returns attachments whose conversation or uploader no longer exists.
+func (r attachment) GetOrphaned(ctx context.Context, limit int) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+	err := r.DB.Table("attachments").
+		Select("attachments.*").
+		Joins("LEFT JOIN conversations ON conversations.id = attachments.conversation_id AND conversations.deleted_at IS NULL").
+		Joins("LEFT JOIN users ON users.id = attachments.uploader_id AND users.deleted_at IS NULL").
+		Where("attachments.deleted_at IS NULL").
+		Where("conversations.id IS NULL OR users.id IS NULL").
+		Limit(limit).
+		Find(&attachments).Error
+	return attachments, err
+}
+
+func (r attachment) Delete(ctx context.Context, id uint64) error {
+	return r.DB.Delete(&models.Attachment{}, id).Error
+}
@@ -9,7 +9,10 @@ import (
 
 type ConversationRepository interface {
 	Create(ctx context.Context, conversation *models.Conversation) error
+	CreateWithParticipants(ctx context.Context, conversation *models.Conversation, participants []models.Participant) error
 	Get(ctx context.Context, id uint64) (*models.Conversation, error)
+	GetByPairKey(ctx context.Context, pairKey string) (*models.Conversation, error)
+	SearchPublicChannels(ctx context.Context, search string, limit, offset int) ([]models.Conversation, error)
 	Update(ctx context.Context, conversation *models.Conversation) error
 	Delete(ctx context.Context, id uint64) error
 }
@@ -26,14 +29,49 @@ func (r conversation) Create(ctx context.Context, conversation *models.Conversat
 	return r.DB.Create(&conversation).Error
 }
 
+// CreateWithParticipants inserts a conversation and its participants in one
+// transaction, so a conversation never exists without them.
+func (r conversation) CreateWithParticipants(ctx context.Context, conversation *models.Conversation, participants []models.Participant) error {
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(conversation).Error; err != nil {
+			return err
+		}
+		for i := range participants {
+			participants[i].ConversationID = conversation.ID
+		}
+		return tx.Create(&participants).Error
+	})
+}
+
 func (r conversation) Get(ctx context.Context, id uint64) (*models.Conversation, error) {
 	var c models.Conversation
 	err := r.DB.First(&c, id).Error
 	return &c, err
 }
 
+func (r conversation) GetByPairKey(ctx context.Context, pairKey string) (*models.Conversation, error) {
+	var c models.Conversation
+	err := r.DB.Where("pair_key = ?", pairKey).First(&c).Error
+	return &c, err
+}
+
+// SearchPublicChannels returns public channels whose name or description
+// contains search, all of them if it is empty, by name.
+func (r conversation) SearchPublicChannels(ctx context.Context, search string, limit, offset int) ([]models.Conversation, error) {
+	var channels []models.Conversation
+	stmt := r.DB.Where("type = ? AND public", models.ConversationTypeChannel)
+	if search != "" {
+		pattern := "%" + search + "%"
+		stmt = stmt.Where("name ILIKE ? OR description ILIKE ?", pattern, pattern)
+	}
+	err := stmt.Order("name, id").Limit(limit).Offset(offset).Find(&channels).Error
+	return channels, err
+}
+
+// Update saves the conversation. last_seq is owned by message inserts and
+// never overwritten from a possibly stale copy.
 func (r conversation) Update(ctx context.Context, conversation *models.Conversation) error {
-	return r.DB.Save(&conversation).Error
+	return r.DB.Omit("last_seq").Save(&conversation).Error
 }
 
 func (r conversation) Delete(ctx context.Context, id uint64) error {
@@ -13,6 +13,7 @@ type FriendshipRepository interface {
 	GetByUserID(ctx context.Context, userID uint64) ([]models.Friendship, error)
 	GetByFriendID(ctx context.Context, friendID uint64) ([]models.Friendship, error)
 	GetByUserIDAndFriendID(ctx context.Context, userID, friendID uint64) (*models.Friendship, error)
+	GetAcceptedFriendIDs(ctx context.Context, userID uint64) ([]uint64, error)
 	Update(ctx context.Context, friendship *models.Friendship) error
 	Delete(ctx context.Context, id uint64) error
 }
@@ -53,6 +54,24 @@ func (r friendship) GetByUserIDAndFriendID(ctx context.Context, userID, friendID
 	return &f, err
 }
 
+func (r friendship) GetAcceptedFriendIDs(ctx context.Context, userID uint64) ([]uint64, error) {
+	var friendships []models.Friendship
+	err := r.DB.Where("status = ? AND (user_id = ? OR friend_id = ?)", "accepted", userID, userID).Find(&friendships).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(friendships))
+	for _, f := range friendships {
+		if f.UserID == userID {
+			ids = append(ids, f.FriendID)
+		} else {
+			ids = append(ids, f.UserID)
+		}
+	}
+	return ids, nil
+}
+
 func (r friendship) Update(ctx context.Context, friendship *models.Friendship) error {
 	return r.DB.Save(&friendship).Error
 }
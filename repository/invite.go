@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/baohuamap/zchat-api/models"
+	"gorm.io/gorm"
+)
+
+type InviteRepository interface {
+	Create(ctx context.Context, link *models.InviteLink) error
+	Get(ctx context.Context, id uint64) (*models.InviteLink, error)
+	GetByToken(ctx context.Context, token string) (*models.InviteLink, error)
+	GetByConversationID(ctx context.Context, conversationID uint64) ([]models.InviteLink, error)
+	Use(ctx context.Context, id uint64) (bool, error)
+	Delete(ctx context.Context, id uint64) error
+
+	CreateJoinRequest(ctx context.Context, req *models.JoinRequest) error
+	GetJoinRequest(ctx context.Context, id uint64) (*models.JoinRequest, error)
+	GetPendingJoinRequest(ctx context.Context, conversationID, userID uint64) (*models.JoinRequest, error)
+	GetPendingJoinRequests(ctx context.Context, conversationID uint64) ([]models.JoinRequest, error)
+	UpdateJoinRequest(ctx context.Context, req *models.JoinRequest) error
+}
+
+type invite struct {
+	DB *gorm.DB
+}
+
+func NewInviteRepository(DB *gorm.DB) InviteRepository {
+	return &invite{DB: DB}
+}
+
+func (r invite) Create(ctx context.Context, link *models.InviteLink) error {
+	return r.DB.Create(&link).Error
+}
+
+// Get also returns revoked links, so pending requests made through them
+// can still be decided.
+func (r invite) Get(ctx context.Context, id uint64) (*models.InviteLink, error) {
+	var l models.InviteLink
+	err := r.DB.Unscoped().First(&l, id).Error
+	return &l, err
+}
+
+func (r invite) GetByToken(ctx context.Context, token string) (*models.InviteLink, error) {
+	var l models.InviteLink
+	err := r.DB.Where("token = ?", token).First(&l).Error
+	return &l, err
+}
+
+func (r invite) GetByConversationID(ctx context.Context, conversationID uint64) ([]models.InviteLink, error) {
+	var links []models.InviteLink
+	err := r.DB.Where("conversation_id = ?", conversationID).Order("created_at").Find(&links).Error
+	return links, err
+}
+
+// Use counts one join through a link. It reports false, counting nothing,
+// when the link has no uses left.
+func (r invite) Use(ctx context.Context, id uint64) (bool, error) {
+	res := r.DB.Unscoped().Model(&models.InviteLink{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", id).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r invite) Delete(ctx context.Context, id uint64) error {
+	return r.DB.Delete(&models.InviteLink{}, id).Error
+}
+
+func (r invite) CreateJoinRequest(ctx context.Context, req *models.JoinRequest) error {
+	return r.DB.Create(&req).Error
+}
+
+func (r invite) GetJoinRequest(ctx context.Context, id uint64) (*models.JoinRequest, error) {
+	var jr models.JoinRequest
+	err := r.DB.First(&jr, id).Error
+	return &jr, err
+}
+
+func (r invite) GetPendingJoinRequest(ctx context.Context, conversationID, userID uint64) (*models.JoinRequest, error) {
+	var jr models.JoinRequest
+	err := r.DB.Where("conversation_id = ? AND user_id = ? AND status = ?", conversationID, userID, models.JoinRequestPending).
+		First(&jr).Error
+	return &jr, err
+}
+
+func (r invite) GetPendingJoinRequests(ctx context.Context, conversationID uint64) ([]models.JoinRequest, error) {
+	var requests []models.JoinRequest
+	err := r.DB.Where("conversation_id = ? AND status = ?", conversationID, models.JoinRequestPending).
+		Preload("User").
+		Order("created_at").
+		Find(&requests).Error
+	return requests, err
+}
+
+func (r invite) UpdateJoinRequest(ctx context.Context, req *models.JoinRequest) error {
+	return r.DB.Omit("User").Save(&req).Error
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/baohuamap/zchat-api/models"
 
@@ -13,9 +14,14 @@ type MessageRepository interface {
 	Create(ctx context.Context, user *models.Message) error
 	Get(ctx context.Context, id uint) (*models.Message, error)
 	GetByConversationID(ctx context.Context, conversationID uint64) ([]models.Message, error)
+	GetByConversationIDInRange(ctx context.Context, conversationID, afterSeq uint64, before *time.Time) ([]models.Message, error)
 	GetLatestByConversationID(ctx context.Context, conversationID uint64) (*models.Message, error)
+	GetByConversationIDAfterSeq(ctx context.Context, conversationID, seq uint64, before *time.Time, limit int) ([]models.Message, error)
 	GetBySenderID(ctx context.Context, userID uint64) ([]models.Message, error)
+	GetBySenderIDAndClientMsgID(ctx context.Context, userID uint64, clientMsgID string) (*models.Message, error)
 	GetBySenderIDAndConversationID(ctx context.Context, userID, conversationID uint64) ([]models.Message, error)
+	GetPinnedByConversationID(ctx context.Context, conversationID uint64) ([]models.Message, error)
+	SetPinned(ctx context.Context, id uint64, pinnedByID *uint64, pinnedAt *time.Time) error
 	Update(ctx context.Context, message *models.Message) error
 	Delete(ctx context.Context, id uint) error
 }
@@ -28,8 +34,20 @@ func NewMessageRepository(DB *gorm.DB) MessageRepository {
 	return &message{DB: DB}
 }
 
+// Create assigns the next sequence number of the message's conversation and
+// inserts it in the same transaction.
 func (r message) Create(ctx context.Context, msg *models.Message) error {
-	return r.DB.Create(&msg).Error
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Raw(`UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ? RETURNING last_seq`, msg.ConversationID).
+			Scan(&msg.Seq).Error
+		if err != nil {
+			return err
+		}
+		if msg.Seq == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Create(&msg).Error
+	})
 }
 
 func (r message) Get(ctx context.Context, id uint) (*models.Message, error) {
@@ -44,6 +62,18 @@ func (r message) GetByConversationID(ctx context.Context, conversationID uint64)
 	return messages, err
 }
 
+// GetByConversationIDInRange returns the messages after afterSeq and, if
+// before is set, created before it.
+func (r message) GetByConversationIDInRange(ctx context.Context, conversationID, afterSeq uint64, before *time.Time) ([]models.Message, error) {
+	var messages []models.Message
+	stmt := r.DB.Where("conversation_id = ? AND seq > ?", conversationID, afterSeq)
+	if before != nil {
+		stmt = stmt.Where("created_at < ?", *before)
+	}
+	err := stmt.Order("seq").Find(&messages).Error
+	return messages, err
+}
+
 func (r message) GetLatestByConversationID(ctx context.Context, conversationID uint64) (*models.Message, error) {
 	var message models.Message
 	err := r.DB.Where("conversation_id = ?", conversationID).Preload("Sender").Last(&message).Error
@@ -56,18 +86,56 @@ func (r message) GetLatestByConversationID(ctx context.Context, conversationID u
 	return &message, err
 }
 
+// GetByConversationIDAfterSeq pages through the messages after seq, and
+// before the given time when it is set.
+func (r message) GetByConversationIDAfterSeq(ctx context.Context, conversationID, seq uint64, before *time.Time, limit int) ([]models.Message, error) {
+	var messages []models.Message
+	stmt := r.DB.Where("conversation_id = ? AND seq > ?", conversationID, seq)
+	if before != nil {
+		stmt = stmt.Where("created_at < ?", *before)
+	}
+	err := stmt.Preload("Sender").
+		Order("seq").
+		Limit(limit).
+		Find(&messages).Error
+	return messages, err
+}
+
 func (r message) GetBySenderID(ctx context.Context, userID uint64) ([]models.Message, error) {
 	var messages []models.Message
 	err := r.DB.Where("sender_id = ?", userID).Find(&messages).Error
 	return messages, err
 }
 
+func (r message) GetBySenderIDAndClientMsgID(ctx context.Context, userID uint64, clientMsgID string) (*models.Message, error) {
+	var m models.Message
+	err := r.DB.Where("sender_id = ? AND client_msg_id = ?", userID, clientMsgID).First(&m).Error
+	return &m, err
+}
+
 func (r message) GetBySenderIDAndConversationID(ctx context.Context, userID, conversationID uint64) ([]models.Message, error) {
 	var messages []models.Message
 	err := r.DB.Where("sender_id = ? AND conversation_id = ?", userID, conversationID).Find(&messages).Error
 	return messages, err
 }
 
+// GetPinnedByConversationID returns the pinned messages of a conversation,
+// most recently pinned first.
+func (r message) GetPinnedByConversationID(ctx context.Context, conversationID uint64) ([]models.Message, error) {
+	var messages []models.Message
+	err := r.DB.Where("conversation_id = ? AND pinned_at IS NOT NULL", conversationID).
+		Order("pinned_at DESC").
+		Find(&messages).Error
+	return messages, err
+}
+
+// SetPinned pins a message, or unpins it when pinnedAt is nil.
+func (r message) SetPinned(ctx context.Context, id uint64, pinnedByID *uint64, pinnedAt *time.Time) error {
+	return r.DB.Model(&models.Message{}).
+		Where("id = ?", id).
+		UpdateColumns(map[string]any{"pinned_at": pinnedAt, "pinned_by_id": pinnedByID}).Error
+}
+
 func (r message) Update(ctx context.Context, message *models.Message) error {
 	return r.DB.Save(&message).Error
 }
@@ -15,7 +15,13 @@ type ParticipantRepository interface {
 	GetByUserID(ctx context.Context, userID uint64) ([]models.Participant, error)
 	GetByConversationID(ctx context.Context, conversationID uint64) ([]models.Participant, error)
 	GetByUserIDAndConversationID(ctx context.Context, userID, conversationID uint64) (models.Participant, error)
-	Update(ctx context.Context, participant models.Participant) error
+	GetFormerByUserIDAndConversationID(ctx context.Context, userID, conversationID uint64) (models.Participant, error)
+	GetSuccessor(ctx context.Context, conversationID uint64) (models.Participant, error)
+	CountByConversationIDs(ctx context.Context, conversationIDs []uint64) (map[uint64]int64, error)
+	UpdateRole(ctx context.Context, id uint64, from, to models.ParticipantRole) error
+	UpdateSettings(ctx context.Context, id uint64, settings map[string]any) error
+	RaiseClearedSeq(ctx context.Context, id uint64, seq uint64) error
+	RaiseUnhideSeq(ctx context.Context, id uint64, seq uint64) error
 	Delete(ctx context.Context, id uint64) error
 }
 
@@ -59,8 +65,100 @@ func (r participant) GetByUserIDAndConversationID(ctx context.Context, userID, c
 	return p, err
 }
 
-func (r participant) Update(ctx context.Context, participant models.Participant) error {
-	return r.DB.Save(&participant).Error
+// GetFormerByUserIDAndConversationID returns the most recent participation
+// the user left or was removed from; its DeletedAt is when that happened.
+func (r participant) GetFormerByUserIDAndConversationID(ctx context.Context, userID, conversationID uint64) (models.Participant, error) {
+	var p models.Participant
+	err := r.DB.Unscoped().
+		Where("user_id = ? AND conversation_id = ? AND deleted_at IS NOT NULL", userID, conversationID).
+		Order("deleted_at DESC").
+		First(&p).Error
+	return p, err
+}
+
+// GetSuccessor returns the participant next in line to own a conversation:
+// the longest-standing admin, or failing that member. participant_role
+// sorts owner, admin, member.
+func (r participant) GetSuccessor(ctx context.Context, conversationID uint64) (models.Participant, error) {
+	var p models.Participant
+	err := r.DB.Where("conversation_id = ?", conversationID).
+		Order("role, created_at").
+		First(&p).Error
+	return p, err
+}
+
+// CountByConversationIDs returns the number of current participants of each
+// conversation; conversations without any are absent.
+func (r participant) CountByConversationIDs(ctx context.Context, conversationIDs []uint64) (map[uint64]int64, error) {
+	var rows []struct {
+		ConversationID uint64
+		Count          int64
+	}
+	err := r.DB.Model(&models.Participant{}).
+		Select("conversation_id, COUNT(*) AS count").
+		Where("conversation_id IN ?", conversationIDs).
+		Group("conversation_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.ConversationID] = row.Count
+	}
+	return counts, nil
+}
+
+// UpdateRole changes a current participant's role from one role to
+// another. It returns gorm.ErrRecordNotFound when the participant has left
+// or no longer has role from, so concurrent role changes cannot undo each
+// other.
+func (r participant) UpdateRole(ctx context.Context, id uint64, from, to models.ParticipantRole) error {
+	res := r.DB.Model(&models.Participant{}).
+		Where("id = ? AND role = ? AND deleted_at IS NULL", id, from).
+		UpdateColumn("role", to)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UpdateSettings writes only the given per-participant setting columns.
+// It returns gorm.ErrRecordNotFound when the participant has left.
+func (r participant) UpdateSettings(ctx context.Context, id uint64, settings map[string]any) error {
+	return r.updateColumns(id, settings)
+}
+
+// RaiseClearedSeq moves the participant's cleared-history watermark up to
+// seq. It never moves it back.
+func (r participant) RaiseClearedSeq(ctx context.Context, id uint64, seq uint64) error {
+	return r.updateColumns(id, map[string]any{"cleared_seq": gorm.Expr("GREATEST(cleared_seq, ?)", seq)})
+}
+
+// RaiseUnhideSeq hides the conversation from the participant until seq. It
+// never moves the watermark back.
+func (r participant) RaiseUnhideSeq(ctx context.Context, id uint64, seq uint64) error {
+	return r.updateColumns(id, map[string]any{"unhide_seq": gorm.Expr("GREATEST(unhide_seq, ?)", seq)})
+}
+
+// updateColumns sets columns of a current participant without touching
+// the rest of the row, so concurrent changes to other columns survive and
+// a removed participant is never written back.
+func (r participant) updateColumns(id uint64, columns map[string]any) error {
+	res := r.DB.Model(&models.Participant{}).
+		Where("id = ? AND deleted_at IS NULL", id).
+		UpdateColumns(columns)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
 
 func (r participant) Delete(ctx context.Context, id uint64) error {
@@ -70,10 +168,13 @@ func (r participant) Delete(ctx context.Context, id uint64) error {
 func (r participant) GetConversationByParticipants(ctx context.Context, userID uint64) ([]models.Conversation, error) {
 	var conversations []models.Conversation
 	stmt := r.DB.Table("participants").
-		Select("conversations.id, conversations.name, conversations.created_at, MAX(messages.created_at) AS last_message_time").
+		Select("conversations.id, conversations.name, conversations.type, conversations.creator_id, conversations.public, "+
+			"conversations.description, conversations.avatar, "+
+			"conversations.avatar_small, conversations.avatar_medium, conversations.avatar_large, "+
+			"conversations.last_seq, conversations.created_at, MAX(messages.created_at) AS last_message_time").
 		Joins("JOIN conversations ON participants.conversation_id = conversations.id").
 		Joins("LEFT JOIN messages ON messages.conversation_id = conversations.id").
-		Where("participants.user_id = ?", userID).
+		Where("participants.user_id = ? AND participants.deleted_at IS NULL", userID).
 		Group("conversations.id, conversations.name, conversations.created_at").
 		Order("last_message_time DESC").
 		Find(&conversations)
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// Tx holds repositories bound to one database transaction.
+type Tx struct {
+	Participants ParticipantRepository
+	Messages     MessageRepository
+	Invites      InviteRepository
+}
+
+type Transactor interface {
+	// Transaction runs fn in a transaction, committed when fn returns nil
+	// and rolled back otherwise.
+	Transaction(ctx context.Context, fn func(tx Tx) error) error
+}
+
+type transactor struct {
+	DB *gorm.DB
+}
+
+func NewTransactor(DB *gorm.DB) Transactor {
+	return &transactor{DB: DB}
+}
+
+func (t transactor) Transaction(ctx context.Context, fn func(tx Tx) error) error {
+	return t.DB.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		return fn(Tx{
+			Participants: NewParticipantRepository(db),
+			Messages:     NewMessageRepository(db),
+			Invites:      NewInviteRepository(db),
+		})
+	})
+}
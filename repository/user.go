@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/baohuamap/zchat-api/models"
 
@@ -17,6 +18,7 @@ type UserRepository interface {
 	GetByEmail(ctx context.Context, email string) (*models.User, error)
 	GetByPhone(ctx context.Context, phone string) (*models.User, error)
 	Update(ctx context.Context, user *models.User) error
+	UpdateLastSeen(ctx context.Context, id uint64, lastSeenAt time.Time) error
 }
 
 type user struct {
@@ -76,3 +78,7 @@ func (r user) SearchWithExclude(ctx context.Context, search string, excludeID ui
 func (r user) Update(ctx context.Context, user *models.User) error {
 	return r.DB.Save(&user).Error
 }
+
+func (r user) UpdateLastSeen(ctx context.Context, id uint64, lastSeenAt time.Time) error {
+	return r.DB.Model(&models.User{}).Where("id = ?", id).UpdateColumn("last_seen_at", lastSeenAt).Error
+}
@@ -34,13 +34,53 @@ func SetupRoutes(r *gin.Engine, httpHandler http.Handler, wsHandler ws.Handler)
 	r.GET("/sentFriendRequests/:userId", httpHandler.GetSentFriendRequests)
 	r.GET("/receivedFriendRequests/:friendId", httpHandler.GetReceivedFriendRequests)
 
-	r.GET("/conversations/:conversationId/messages", httpHandler.LoadMessages)
+	// authenticated
+	me := r.Group("/me", middleware.AuthMiddleware())
+	me.GET("/storage", httpHandler.GetStorageUsage)
+	me.PUT("/privacy", httpHandler.UpdatePrivacy)
 
-	r.POST("/conversations/:conversationId/addParticipants", httpHandler.AddParticipants)
+	conv := r.Group("/conversations/:conversationId", middleware.AuthMiddleware())
+	conv.PATCH("", httpHandler.UpdateConversation)
+	conv.POST("/avatar", httpHandler.UploadConversationAvatar)
+	conv.PATCH("/settings", httpHandler.UpdateConversationSettings)
+	conv.POST("/clear", httpHandler.ClearHistory)
+	conv.POST("/hide", httpHandler.HideConversation)
+	conv.GET("/messages", httpHandler.LoadMessages)
+	conv.POST("/messages", httpHandler.SendMessage)
+	conv.GET("/pins", httpHandler.ListPinnedMessages)
+	conv.POST("/messages/:messageId/pin", httpHandler.PinMessage)
+	conv.DELETE("/messages/:messageId/pin", httpHandler.UnpinMessage)
+	conv.POST("/attachments", httpHandler.UploadAttachment)
+	conv.POST("/addParticipants", httpHandler.AddParticipants)
+	conv.POST("/participants/:userId/promote", httpHandler.PromoteParticipant)
+	conv.POST("/participants/:userId/demote", httpHandler.DemoteParticipant)
+	conv.DELETE("/participants/:userId", httpHandler.RemoveParticipant)
+	conv.POST("/leave", httpHandler.LeaveConversation)
+	conv.POST("/invites", httpHandler.CreateInviteLink)
+	conv.GET("/invites", httpHandler.ListInviteLinks)
+	conv.DELETE("/invites/:inviteId", httpHandler.RevokeInviteLink)
+	conv.GET("/joinRequests", httpHandler.ListJoinRequests)
+	conv.POST("/joinRequests/:requestId/approve", httpHandler.ApproveJoinRequest)
+	conv.POST("/joinRequests/:requestId/reject", httpHandler.RejectJoinRequest)
+
+	invites := r.Group("/invites", middleware.AuthMiddleware())
+	invites.POST("/:token/join", httpHandler.JoinByInvite)
+
+	r.GET("/channels", httpHandler.DiscoverChannels)
+	channels := r.Group("/channels/:conversationId", middleware.AuthMiddleware())
+	channels.POST("/subscribe", httpHandler.SubscribeChannel)
+	channels.DELETE("/subscribe", httpHandler.LeaveConversation)
 	// r.POST("/seenMessages/:conversationId", httpHandler.SeenMessages)
 
 	// ws
-	r.POST("/ws/createConversation", wsHandler.CreateConversation)
-	r.GET("/ws/joinConversation/:conversationId", wsHandler.JoinConversation)
+	wsAuth := r.Group("/ws", middleware.AuthMiddleware())
+	wsAuth.POST("/createConversation", wsHandler.CreateConversation)
+	wsAuth.GET("/joinConversation/:conversationId", wsHandler.JoinConversation)
+	wsAuth.GET("/connect", wsHandler.Connect)
 	r.GET("/ws/getClients/:conversationId", wsHandler.GetClients)
+	r.GET("/ws/presence/:userId", wsHandler.GetFriendsPresence)
+
+	// fallback transports for clients that cannot use WebSockets
+	wsAuth.GET("/events", wsHandler.Events)
+	wsAuth.GET("/poll", wsHandler.Poll)
 }
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strconv"
+
+	"github.com/baohuamap/zchat-api/pkg/aws"
+	"github.com/baohuamap/zchat-api/pkg/imgproc"
+)
+
+// avatarSizes are the square edge lengths, in pixels, rendered for every avatar.
+var avatarSizes = []int{64, 256, 512}
+
+// avatarSet is an uploaded avatar: the key prefix its variants share and
+// their URLs by size.
+type avatarSet struct {
+	key  string
+	urls map[int]string
+}
+
+// uploadAvatar renders every variant of an avatar image and stores them
+// under prefix, e.g. "42/avatar".
+func uploadAvatar(ctx context.Context, s3 aws.S3Client, prefix string, file io.Reader) (*avatarSet, error) {
+	img, err := imgproc.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := imgproc.Avatar(img, avatarSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Variants share a key prefix derived from the largest rendition, so
+	// re-uploading the same picture maps onto the same objects.
+	sum := sha256.Sum256(variants[len(variants)-1].Data)
+	set := &avatarSet{
+		key:  prefix + "/" + hex.EncodeToString(sum[:16]),
+		urls: make(map[int]string, len(variants)),
+	}
+
+	for _, v := range variants {
+		variantKey := avatarVariantKey(set.key, v.Size)
+		if err := s3.PutObject(ctx, variantKey, bytes.NewReader(v.Data), v.ContentType); err != nil {
+			return nil, err
+		}
+		set.urls[v.Size] = s3.GetFileURL(variantKey)
+	}
+	return set, nil
+}
+
+// deleteAvatar removes the variants of a replaced avatar. Failures only
+// leave orphaned objects behind, so they are logged and ignored.
+func deleteAvatar(ctx context.Context, s3 aws.S3Client, oldKey string, newKey string) {
+	if oldKey == "" || oldKey == newKey {
+		return
+	}
+	for _, size := range avatarSizes {
+		if err := s3.DeleteFile(ctx, avatarVariantKey(oldKey, size)); err != nil {
+			slog.Error("Error deleting old avatar", "key", oldKey, "error", err)
+		}
+	}
+}
+
+func avatarVariantKey(prefix string, size int) string {
+	return prefix + "_" + strconv.Itoa(size) + ".jpg"
+}
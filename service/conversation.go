@@ -0,0 +1,819 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/models"
+	"github.com/baohuamap/zchat-api/pkg/aws"
+	repo "github.com/baohuamap/zchat-api/repository"
+)
+
+var (
+	ErrForbidden          = errors.New("not permitted for this participant role")
+	ErrInvalidRoleChange  = errors.New("participant's role cannot be changed this way")
+	ErrParticipantMissing = errors.New("participant not found")
+	ErrAlreadyParticipant = errors.New("user is already a participant")
+	ErrNameTooLong        = errors.New("conversation name is too long")
+	ErrDescriptionTooLong = errors.New("conversation description is too long")
+	ErrInvalidSettings    = errors.New("invalid conversation settings")
+)
+
+// Longest conversation name and description accepted, in runes.
+const (
+	maxConversationName        = 100
+	maxConversationDescription = 500
+)
+
+// action is a conversation change gated by participant role.
+type action int
+
+const (
+	actionPost action = iota
+	actionAddMembers
+	actionRemoveMembers
+	actionRename
+	actionChangeAvatar
+	actionPin
+	actionManageRoles
+	actionManageInvites
+)
+
+// allowed reports whether a participant with role may perform a in a
+// conversation of type typ. Roles only apply to groups and channels: both
+// sides of a private conversation may post, rename or pin, but never
+// change membership. Channel members only read.
+func allowed(typ models.ConversationType, role models.ParticipantRole, a action) bool {
+	if typ == models.ConversationTypePrivate {
+		return a == actionPost || a == actionRename || a == actionChangeAvatar || a == actionPin
+	}
+
+	switch role {
+	case models.ParticipantRoleOwner:
+		return true
+	case models.ParticipantRoleAdmin:
+		return a != actionManageRoles
+	default:
+		return a == actionPost && typ != models.ConversationTypeChannel
+	}
+}
+
+// rank orders roles by authority. Participants may only remove those
+// ranked below them.
+func rank(role models.ParticipantRole) int {
+	switch role {
+	case models.ParticipantRoleOwner:
+		return 2
+	case models.ParticipantRoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type Conversation interface {
+	AddParticipants(c context.Context, conversationID uint64, actorID uint64, userIDs []uint64) error
+	PromoteParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error
+	DemoteParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error
+	RemoveParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error
+	LeaveConversation(c context.Context, conversationID uint64, userID uint64) error
+	UpdateConversation(c context.Context, conversationID uint64, actorID uint64, req *dto.UpdateConversationReq) (*dto.ConversationRes, error)
+	UploadAvatar(c context.Context, conversationID uint64, actorID uint64, file io.Reader) (*dto.UploadAvatarRes, error)
+	UpdateSettings(c context.Context, conversationID uint64, userID uint64, req *dto.UpdateConversationSettingsReq) (*dto.ConversationSettingsRes, error)
+	ClearHistory(c context.Context, conversationID uint64, userID uint64, upToSeq uint64) error
+	HideConversation(c context.Context, conversationID uint64, userID uint64) error
+	PinMessage(c context.Context, conversationID uint64, actorID uint64, messageID uint64) error
+	UnpinMessage(c context.Context, conversationID uint64, actorID uint64, messageID uint64) error
+	ListPinnedMessages(c context.Context, conversationID uint64, userID uint64) (*dto.MessageListRes, error)
+
+	CreateInviteLink(c context.Context, conversationID uint64, actorID uint64, req *dto.CreateInviteLinkReq) (*dto.InviteLinkRes, error)
+	ListInviteLinks(c context.Context, conversationID uint64, actorID uint64) ([]dto.InviteLinkRes, error)
+	RevokeInviteLink(c context.Context, conversationID uint64, actorID uint64, linkID uint64) error
+	JoinByInvite(c context.Context, token string, userID uint64) (*dto.JoinByInviteRes, error)
+	ListJoinRequests(c context.Context, conversationID uint64, actorID uint64) ([]dto.JoinRequestRes, error)
+	ApproveJoinRequest(c context.Context, conversationID uint64, actorID uint64, requestID uint64) error
+	RejectJoinRequest(c context.Context, conversationID uint64, actorID uint64, requestID uint64) error
+
+	DiscoverChannels(c context.Context, search string, limit, offset int) (*dto.ChannelListRes, error)
+	Subscribe(c context.Context, conversationID uint64, userID uint64) error
+}
+
+type convService struct {
+	cRepo     repo.ConversationRepository
+	pRepo     repo.ParticipantRepository
+	mRepo     repo.MessageRepository
+	uRepo     repo.UserRepository
+	iRepo     repo.InviteRepository
+	tx        repo.Transactor
+	s3Client  aws.S3Client
+	publisher MessagePublisher
+}
+
+func NewConversationService(
+	convRepo repo.ConversationRepository, participantRepo repo.ParticipantRepository,
+	msgRepo repo.MessageRepository, userRepo repo.UserRepository, inviteRepo repo.InviteRepository,
+	tx repo.Transactor, s3 aws.S3Client, publisher MessagePublisher,
+) Conversation {
+	return &convService{
+		cRepo:     convRepo,
+		pRepo:     participantRepo,
+		mRepo:     msgRepo,
+		uRepo:     userRepo,
+		iRepo:     inviteRepo,
+		tx:        tx,
+		s3Client:  s3,
+		publisher: publisher,
+	}
+}
+
+// authorize loads the conversation and the acting participant and checks
+// that the actor may perform a.
+func (s *convService) authorize(c context.Context, conversationID uint64, actorID uint64, a action) (*models.Conversation, *models.Participant, error) {
+	conv, err := s.conversation(c, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	actor, err := s.pRepo.GetByUserIDAndConversationID(c, actorID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrNotParticipant
+		}
+		slog.Error("Failed to get participant", "error", err)
+		return nil, nil, err
+	}
+
+	if !allowed(conv.Type, actor.Role, a) {
+		return nil, nil, ErrForbidden
+	}
+	return conv, &actor, nil
+}
+
+func (s *convService) conversation(c context.Context, conversationID uint64) (*models.Conversation, error) {
+	conv, err := s.cRepo.Get(c, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConversationNotFound
+		}
+		slog.Error("Failed to get conversation", "error", err)
+		return nil, err
+	}
+	return conv, nil
+}
+
+// target loads the participant an action is applied to.
+func (s *convService) target(c context.Context, conversationID uint64, userID uint64) (models.Participant, error) {
+	p, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return p, ErrParticipantMissing
+		}
+		slog.Error("Failed to get participant", "error", err)
+		return p, err
+	}
+	return p, nil
+}
+
+func (s *convService) AddParticipants(c context.Context, conversationID uint64, actorID uint64, userIDs []uint64) error {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionAddMembers); err != nil {
+		return err
+	}
+
+	participants := make([]models.Participant, 0, len(userIDs))
+	seen := make(map[uint64]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		// Check if the user is already a participant
+		_, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+		if err == nil {
+			slog.Info("User is already a participant", "userID", userID)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("Failed to get participant", "error", err)
+			return err
+		}
+
+		participants = append(participants, models.Participant{
+			UserID:         userID,
+			ConversationID: conversationID,
+			Role:           models.ParticipantRoleMember,
+		})
+	}
+	if len(participants) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(participants))
+	for _, p := range participants {
+		names = append(names, s.username(c, p.UserID))
+	}
+
+	var msg *models.Message
+	err := s.tx.Transaction(c, func(tx repo.Tx) error {
+		if err := tx.Participants.BulkCreate(c, participants); err != nil {
+			return err
+		}
+		var err error
+		msg, err = s.newSystemMessage(c, tx.Messages, conversationID, actorID, "added "+strings.Join(names, ", "))
+		return err
+	})
+	if err != nil {
+		// A concurrent add got one of the users in first.
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrAlreadyParticipant
+		}
+		slog.Error("Failed to add participant", "error", err)
+		return err
+	}
+
+	s.publishSystemMessages(c, msg)
+	return nil
+}
+
+// PromoteParticipant makes a member an admin. Only the owner may.
+func (s *convService) PromoteParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error {
+	return s.changeRole(c, conversationID, actorID, userID, models.ParticipantRoleMember, models.ParticipantRoleAdmin)
+}
+
+// DemoteParticipant makes an admin a member again. Only the owner may.
+func (s *convService) DemoteParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error {
+	return s.changeRole(c, conversationID, actorID, userID, models.ParticipantRoleAdmin, models.ParticipantRoleMember)
+}
+
+func (s *convService) changeRole(c context.Context, conversationID, actorID, userID uint64, from, to models.ParticipantRole) error {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionManageRoles); err != nil {
+		return err
+	}
+
+	target, err := s.target(c, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if target.Role != from {
+		return ErrInvalidRoleChange
+	}
+
+	if err := s.pRepo.UpdateRole(c, target.ID, from, to); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Removed or given another role meanwhile.
+			if _, err := s.target(c, conversationID, userID); err != nil {
+				return err
+			}
+			return ErrInvalidRoleChange
+		}
+		slog.Error("Failed to update participant role", "error", err)
+		return err
+	}
+
+	verb := "promoted"
+	if to == models.ParticipantRoleMember {
+		verb = "demoted"
+	}
+	return s.systemMessage(c, conversationID, actorID, fmt.Sprintf("%s %s to %s", verb, s.username(c, userID), to))
+}
+
+// RemoveParticipant takes userID out of a group. Owners may remove anyone
+// else, admins only members.
+func (s *convService) RemoveParticipant(c context.Context, conversationID uint64, actorID uint64, userID uint64) error {
+	_, actor, err := s.authorize(c, conversationID, actorID, actionRemoveMembers)
+	if err != nil {
+		return err
+	}
+
+	target, err := s.target(c, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if rank(target.Role) >= rank(actor.Role) {
+		return ErrForbidden
+	}
+
+	var msg *models.Message
+	err = s.tx.Transaction(c, func(tx repo.Tx) error {
+		if err := tx.Participants.Delete(c, target.ID); err != nil {
+			return err
+		}
+		var err error
+		msg, err = s.newSystemMessage(c, tx.Messages, conversationID, actorID, "removed "+s.username(c, userID))
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to remove participant", "error", err)
+		return err
+	}
+
+	s.publisher.RemoveMember(conversationID, userID)
+	s.publishSystemMessages(c, msg)
+	return nil
+}
+
+// LeaveConversation takes userID out of a group or channel. An owner who
+// leaves hands it to the longest-standing admin, or failing that member.
+func (s *convService) LeaveConversation(c context.Context, conversationID uint64, userID uint64) error {
+	conv, err := s.conversation(c, conversationID)
+	if err != nil {
+		return err
+	}
+	if conv.Type == models.ConversationTypePrivate {
+		return ErrForbidden
+	}
+
+	p, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		slog.Error("Failed to get participant", "error", err)
+		return err
+	}
+
+	// Leaving and handing over ownership commit together, so a group is
+	// never left without an owner.
+	var msgs []*models.Message
+	err = s.tx.Transaction(c, func(tx repo.Tx) error {
+		if err := tx.Participants.Delete(c, p.ID); err != nil {
+			return err
+		}
+		// Subscribers come and go from channels without a trace in the timeline.
+		if conv.Type != models.ConversationTypeChannel {
+			msg, err := s.newSystemMessage(c, tx.Messages, conversationID, userID, "left")
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		if p.Role != models.ParticipantRoleOwner {
+			return nil
+		}
+		msg, err := s.transferOwnership(c, tx, conversationID)
+		if err != nil || msg == nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to leave conversation", "error", err)
+		return err
+	}
+
+	s.publisher.RemoveMember(conversationID, userID)
+	s.publishSystemMessages(c, msgs...)
+	return nil
+}
+
+// transferOwnership promotes the next owner of a conversation within tx
+// and returns the system message announcing it, or nil when the owner was
+// the last one out.
+func (s *convService) transferOwnership(c context.Context, tx repo.Tx, conversationID uint64) (*models.Message, error) {
+	next, err := tx.Participants.GetSuccessor(c, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := tx.Participants.UpdateRole(c, next.ID, next.Role, models.ParticipantRoleOwner); err != nil {
+		return nil, err
+	}
+	return s.newSystemMessage(c, tx.Messages, conversationID, next.UserID, "is now the owner")
+}
+
+// UpdateConversation renames a conversation or changes its description.
+func (s *convService) UpdateConversation(c context.Context, conversationID uint64, actorID uint64, req *dto.UpdateConversationReq) (*dto.ConversationRes, error) {
+	conv, _, err := s.authorize(c, conversationID, actorID, actionRename)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if utf8.RuneCountInString(name) > maxConversationName {
+			return nil, ErrNameTooLong
+		}
+		if name != conv.Name {
+			conv.Name = name
+			changes = append(changes, fmt.Sprintf("renamed the conversation to %q", name))
+		}
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxConversationDescription {
+			return nil, ErrDescriptionTooLong
+		}
+		if description != conv.Description {
+			conv.Description = description
+			changes = append(changes, "changed the description")
+		}
+	}
+	if len(changes) == 0 {
+		return conversationRes(conv), nil
+	}
+
+	if err := s.cRepo.Update(c, conv); err != nil {
+		slog.Error("Failed to update conversation", "error", err)
+		return nil, err
+	}
+	s.publisher.PublishConversation(conv)
+
+	for _, change := range changes {
+		if err := s.systemMessage(c, conversationID, actorID, change); err != nil {
+			return nil, err
+		}
+	}
+	return conversationRes(conv), nil
+}
+
+// UploadAvatar replaces the avatar of a conversation.
+func (s *convService) UploadAvatar(c context.Context, conversationID uint64, actorID uint64, file io.Reader) (*dto.UploadAvatarRes, error) {
+	ctx, cancel := context.WithTimeout(c, 30*time.Second)
+	defer cancel()
+
+	conv, _, err := s.authorize(ctx, conversationID, actorID, actionChangeAvatar)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "conversations/" + strconv.FormatUint(conversationID, 10) + "/avatar"
+	avatar, err := uploadAvatar(ctx, s.s3Client, prefix, file)
+	if err != nil {
+		slog.Error("Error uploading conversation avatar", "conversationID", conversationID, "error", err)
+		return nil, err
+	}
+
+	oldKey := conv.AvatarKey
+	conv.AvatarKey = avatar.key
+	conv.AvatarSmall = avatar.urls[avatarSizes[0]]
+	conv.AvatarMedium = avatar.urls[avatarSizes[1]]
+	conv.AvatarLarge = avatar.urls[avatarSizes[2]]
+	conv.Avatar = conv.AvatarMedium
+	if err := s.cRepo.Update(ctx, conv); err != nil {
+		slog.Error("Error updating conversation avatar", "conversationID", conversationID, "error", err)
+		return nil, err
+	}
+	deleteAvatar(ctx, s.s3Client, oldKey, avatar.key)
+	s.publisher.PublishConversation(conv)
+
+	if err := s.systemMessage(ctx, conversationID, actorID, "changed the conversation avatar"); err != nil {
+		return nil, err
+	}
+	return &dto.UploadAvatarRes{
+		URL:     conv.Avatar,
+		Avatars: conversationAvatarURLs(conv),
+	}, nil
+}
+
+// UpdateSettings changes how a conversation appears to one participant.
+// Other participants are unaffected.
+func (s *convService) UpdateSettings(c context.Context, conversationID uint64, userID uint64, req *dto.UpdateConversationSettingsReq) (*dto.ConversationSettingsRes, error) {
+	p, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotParticipant
+		}
+		slog.Error("Failed to get participant", "error", err)
+		return nil, err
+	}
+
+	settings := make(map[string]any)
+	switch {
+	case req.Unmute:
+		p.MutedUntil = nil
+		settings["muted_until"] = nil
+	case req.MutedUntil != nil:
+		p.MutedUntil = req.MutedUntil
+		settings["muted_until"] = *req.MutedUntil
+	}
+	if req.Archived != nil {
+		p.Archived = *req.Archived
+		settings["archived"] = p.Archived
+	}
+	if req.NotificationLevel != nil {
+		switch level := models.NotificationLevel(*req.NotificationLevel); level {
+		case models.NotificationLevelAll, models.NotificationLevelMentions, models.NotificationLevelNone:
+			p.NotificationLevel = level
+			settings["notification_level"] = level
+		default:
+			return nil, ErrInvalidSettings
+		}
+	}
+
+	switch {
+	case req.PinOrder != nil:
+		if *req.PinOrder < 1 {
+			return nil, ErrInvalidSettings
+		}
+		p.PinOrder = *req.PinOrder
+		settings["pin_order"] = p.PinOrder
+	case req.Pinned != nil && !*req.Pinned:
+		p.PinOrder = 0
+		settings["pin_order"] = 0
+	case req.Pinned != nil && p.PinOrder == 0:
+		// Newly pinned conversations go below the existing pins.
+		pins, err := s.pRepo.GetByUserID(c, userID)
+		if err != nil {
+			slog.Error("Failed to get participants", "error", err)
+			return nil, err
+		}
+		for _, other := range pins {
+			p.PinOrder = max(p.PinOrder, other.PinOrder)
+		}
+		p.PinOrder++
+		settings["pin_order"] = p.PinOrder
+	}
+
+	if len(settings) > 0 {
+		if err := s.pRepo.UpdateSettings(c, p.ID, settings); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrNotParticipant
+			}
+			slog.Error("Failed to update conversation settings", "error", err)
+			return nil, err
+		}
+	}
+	return settingsRes(&p, time.Now()), nil
+}
+
+// DiscoverChannels searches the public channels.
+func (s *convService) DiscoverChannels(c context.Context, search string, limit, offset int) (*dto.ChannelListRes, error) {
+	channels, err := s.cRepo.SearchPublicChannels(c, strings.TrimSpace(search), limit, offset)
+	if err != nil {
+		slog.Error("Failed to search channels", "error", err)
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(channels))
+	for _, ch := range channels {
+		ids = append(ids, ch.ID)
+	}
+	counts, err := s.pRepo.CountByConversationIDs(c, ids)
+	if err != nil {
+		slog.Error("Failed to count subscribers", "error", err)
+		return nil, err
+	}
+
+	res := &dto.ChannelListRes{Channels: make([]dto.ChannelRes, 0, len(channels))}
+	for i := range channels {
+		ch := &channels[i]
+		res.Channels = append(res.Channels, dto.ChannelRes{
+			ID:              ch.ID,
+			Name:            ch.Name,
+			Description:     ch.Description,
+			Avatar:          ch.Avatar,
+			Avatars:         conversationAvatarURLs(ch),
+			SubscriberCount: counts[ch.ID],
+		})
+	}
+	return res, nil
+}
+
+// Subscribe makes userID a member of a public channel. Private channels are
+// joined through invite links and look like they do not exist here.
+func (s *convService) Subscribe(c context.Context, conversationID uint64, userID uint64) error {
+	conv, err := s.conversation(c, conversationID)
+	if err != nil {
+		return err
+	}
+	if conv.Type != models.ConversationTypeChannel || !conv.Public {
+		return ErrConversationNotFound
+	}
+
+	member, err := s.isParticipant(c, conversationID, userID)
+	if err != nil || member {
+		return err
+	}
+
+	p := &models.Participant{
+		UserID:         userID,
+		ConversationID: conversationID,
+		Role:           models.ParticipantRoleMember,
+	}
+	if err := s.pRepo.Create(c, p); err != nil {
+		slog.Error("Failed to subscribe", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *convService) PinMessage(c context.Context, conversationID uint64, actorID uint64, messageID uint64) error {
+	return s.setPinned(c, conversationID, actorID, messageID, true)
+}
+
+func (s *convService) UnpinMessage(c context.Context, conversationID uint64, actorID uint64, messageID uint64) error {
+	return s.setPinned(c, conversationID, actorID, messageID, false)
+}
+
+func (s *convService) setPinned(c context.Context, conversationID, actorID, messageID uint64, pinned bool) error {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionPin); err != nil {
+		return err
+	}
+
+	msg, err := s.mRepo.Get(c, uint(messageID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMessageNotFound
+		}
+		slog.Error("Failed to get message", "error", err)
+		return err
+	}
+	if msg.ConversationID != conversationID {
+		return ErrMessageNotFound
+	}
+	if (msg.PinnedAt != nil) == pinned {
+		return nil
+	}
+
+	var pinnedByID *uint64
+	var pinnedAt *time.Time
+	content := "unpinned a message"
+	if pinned {
+		now := time.Now()
+		pinnedByID, pinnedAt = &actorID, &now
+		content = "pinned a message"
+	}
+	if err := s.mRepo.SetPinned(c, messageID, pinnedByID, pinnedAt); err != nil {
+		slog.Error("Failed to pin message", "error", err)
+		return err
+	}
+	return s.systemMessage(c, conversationID, actorID, content)
+}
+
+// ListPinnedMessages returns the pinned messages userID can still see,
+// most recently pinned first.
+func (s *convService) ListPinnedMessages(c context.Context, conversationID uint64, userID uint64) (*dto.MessageListRes, error) {
+	_, p, err := s.membership(c, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := s.mRepo.GetPinnedByConversationID(c, conversationID)
+	if err != nil {
+		slog.Error("Failed to get pinned messages", "error", err)
+		return nil, err
+	}
+
+	res := &dto.MessageListRes{Messages: make([]dto.MessageRes, 0, len(messages))}
+	for i := range messages {
+		if messages[i].Seq > p.ClearedSeq {
+			res.Messages = append(res.Messages, messageRes(&messages[i]))
+		}
+	}
+	return res, nil
+}
+
+// ClearHistory hides the messages up to upToSeq, or all of them if it is
+// 0, from userID's history. Clearing never brings messages back.
+func (s *convService) ClearHistory(c context.Context, conversationID uint64, userID uint64, upToSeq uint64) error {
+	conv, p, err := s.membership(c, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if upToSeq == 0 || upToSeq > conv.LastSeq {
+		upToSeq = conv.LastSeq
+	}
+	if upToSeq <= p.ClearedSeq {
+		return nil
+	}
+
+	if err := s.pRepo.RaiseClearedSeq(c, p.ID, upToSeq); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		slog.Error("Failed to clear history", "error", err)
+		return err
+	}
+	return nil
+}
+
+// HideConversation removes a conversation from userID's list until the
+// next message is sent in it.
+func (s *convService) HideConversation(c context.Context, conversationID uint64, userID uint64) error {
+	conv, p, err := s.membership(c, conversationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.pRepo.RaiseUnhideSeq(c, p.ID, conv.LastSeq+1); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		slog.Error("Failed to hide conversation", "error", err)
+		return err
+	}
+	return nil
+}
+
+// membership loads a conversation and userID's participation in it.
+func (s *convService) membership(c context.Context, conversationID uint64, userID uint64) (*models.Conversation, *models.Participant, error) {
+	conv, err := s.conversation(c, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrNotParticipant
+		}
+		slog.Error("Failed to get participant", "error", err)
+		return nil, nil, err
+	}
+	return conv, &p, nil
+}
+
+func settingsRes(p *models.Participant, now time.Time) *dto.ConversationSettingsRes {
+	res := &dto.ConversationSettingsRes{
+		ConversationID:    p.ConversationID,
+		Muted:             p.Muted(now),
+		Archived:          p.Archived,
+		Pinned:            p.PinOrder > 0,
+		PinOrder:          p.PinOrder,
+		NotificationLevel: string(p.NotificationLevel),
+	}
+	if res.Muted {
+		res.MutedUntil = p.MutedUntil
+	}
+	return res
+}
+
+func conversationRes(conv *models.Conversation) *dto.ConversationRes {
+	return &dto.ConversationRes{
+		ID:          conv.ID,
+		Name:        conv.Name,
+		Description: conv.Description,
+		Avatar:      conv.Avatar,
+		Avatars:     conversationAvatarURLs(conv),
+		Type:        string(conv.Type),
+		CreatorID:   conv.CreatorID,
+		Public:      conv.Public,
+	}
+}
+
+func conversationAvatarURLs(conv *models.Conversation) dto.AvatarURLs {
+	return dto.AvatarURLs{
+		Small:  conv.AvatarSmall,
+		Medium: conv.AvatarMedium,
+		Large:  conv.AvatarLarge,
+	}
+}
+
+// systemMessage records a conversation change made by actorID and
+// broadcasts it like any other message.
+func (s *convService) systemMessage(c context.Context, conversationID uint64, actorID uint64, content string) error {
+	msg, err := s.newSystemMessage(c, s.mRepo, conversationID, actorID, content)
+	if err != nil {
+		slog.Error("Failed to create system message", "error", err)
+		return err
+	}
+	s.publishSystemMessages(c, msg)
+	return nil
+}
+
+// newSystemMessage stores a system message through mRepo without
+// publishing it, for changes that must commit before clients hear of them.
+func (s *convService) newSystemMessage(c context.Context, mRepo repo.MessageRepository, conversationID uint64, actorID uint64, content string) (*models.Message, error) {
+	msg := &models.Message{
+		Content:        s.username(c, actorID) + " " + content,
+		ConversationID: conversationID,
+		SenderID:       actorID,
+		Kind:           models.MessageKindSystem,
+	}
+	if err := mRepo.Create(c, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// publishSystemMessages publishes stored system messages; nil ones are
+// skipped.
+func (s *convService) publishSystemMessages(c context.Context, msgs ...*models.Message) {
+	for _, msg := range msgs {
+		if msg != nil {
+			s.publisher.PublishMessage(msg, s.username(c, msg.SenderID))
+		}
+	}
+}
+
+func (s *convService) username(c context.Context, userID uint64) string {
+	u, err := s.uRepo.Get(c, userID)
+	if err != nil {
+		return fmt.Sprintf("user %d", userID)
+	}
+	return u.Username
+}
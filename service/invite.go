@@ -0,0 +1,339 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/models"
+	repo "github.com/baohuamap/zchat-api/repository"
+)
+
+var (
+	ErrInvalidInvite       = errors.New("invalid invite link settings")
+	ErrInviteNotFound      = errors.New("invite link not found")
+	ErrInviteExpired       = errors.New("invite link has expired")
+	ErrInviteExhausted     = errors.New("invite link has no uses left")
+	ErrJoinRequestNotFound = errors.New("join request not found")
+	ErrJoinRequestDecided  = errors.New("join request was already decided")
+)
+
+// Join statuses reported by JoinByInvite.
+const (
+	joinStatusJoined  = "joined"
+	joinStatusPending = "pending"
+)
+
+func (s *convService) CreateInviteLink(c context.Context, conversationID uint64, actorID uint64, req *dto.CreateInviteLinkReq) (*dto.InviteLinkRes, error) {
+	conv, _, err := s.authorize(c, conversationID, actorID, actionManageInvites)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Type == models.ConversationTypePrivate {
+		return nil, ErrForbidden
+	}
+	if req.MaxUses < 0 || req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidInvite
+	}
+
+	link := &models.InviteLink{
+		Token:           newInviteToken(),
+		ConversationID:  conversationID,
+		CreatorID:       actorID,
+		ExpiresAt:       req.ExpiresAt,
+		MaxUses:         req.MaxUses,
+		RequireApproval: req.RequireApproval,
+	}
+	if err := s.iRepo.Create(c, link); err != nil {
+		slog.Error("Failed to create invite link", "error", err)
+		return nil, err
+	}
+	return inviteLinkRes(link), nil
+}
+
+func (s *convService) ListInviteLinks(c context.Context, conversationID uint64, actorID uint64) ([]dto.InviteLinkRes, error) {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionManageInvites); err != nil {
+		return nil, err
+	}
+
+	links, err := s.iRepo.GetByConversationID(c, conversationID)
+	if err != nil {
+		slog.Error("Failed to get invite links", "error", err)
+		return nil, err
+	}
+	res := make([]dto.InviteLinkRes, 0, len(links))
+	for i := range links {
+		res = append(res, *inviteLinkRes(&links[i]))
+	}
+	return res, nil
+}
+
+// RevokeInviteLink stops a link from admitting anyone. Requests already
+// made through it can still be decided.
+func (s *convService) RevokeInviteLink(c context.Context, conversationID uint64, actorID uint64, linkID uint64) error {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionManageInvites); err != nil {
+		return err
+	}
+
+	link, err := s.iRepo.Get(c, linkID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteNotFound
+		}
+		slog.Error("Failed to get invite link", "error", err)
+		return err
+	}
+	if link.ConversationID != conversationID || link.DeletedAt.Valid {
+		return ErrInviteNotFound
+	}
+
+	if err := s.iRepo.Delete(c, linkID); err != nil {
+		slog.Error("Failed to revoke invite link", "error", err)
+		return err
+	}
+	return nil
+}
+
+// JoinByInvite adds userID to the conversation of an invite link, or files
+// a join request when the link requires approval. Joining a conversation
+// the user is already in succeeds without using the link.
+func (s *convService) JoinByInvite(c context.Context, token string, userID uint64) (*dto.JoinByInviteRes, error) {
+	link, err := s.iRepo.GetByToken(c, token)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInviteNotFound
+		}
+		slog.Error("Failed to get invite link", "error", err)
+		return nil, err
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+
+	res := &dto.JoinByInviteRes{ConversationID: link.ConversationID, Status: joinStatusJoined}
+	member, err := s.isParticipant(c, link.ConversationID, userID)
+	if err != nil || member {
+		return res, err
+	}
+
+	if !link.RequireApproval {
+		var msg *models.Message
+		err := s.tx.Transaction(c, func(tx repo.Tx) error {
+			var err error
+			msg, err = s.admit(c, tx, link, userID, userID, "joined via invite link")
+			return err
+		})
+		if s.joinedMeanwhile(c, err, link.ConversationID, userID) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.publishSystemMessages(c, msg)
+		return res, nil
+	}
+
+	res.Status = joinStatusPending
+	_, err = s.iRepo.GetPendingJoinRequest(c, link.ConversationID, userID)
+	if err == nil {
+		return res, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		slog.Error("Failed to get join request", "error", err)
+		return nil, err
+	}
+	if link.MaxUses > 0 && link.Uses >= link.MaxUses {
+		return nil, ErrInviteExhausted
+	}
+
+	jr := &models.JoinRequest{
+		ConversationID: link.ConversationID,
+		UserID:         userID,
+		InviteLinkID:   link.ID,
+		Status:         models.JoinRequestPending,
+	}
+	if err := s.iRepo.CreateJoinRequest(c, jr); err != nil {
+		slog.Error("Failed to create join request", "error", err)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *convService) ListJoinRequests(c context.Context, conversationID uint64, actorID uint64) ([]dto.JoinRequestRes, error) {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionManageInvites); err != nil {
+		return nil, err
+	}
+
+	requests, err := s.iRepo.GetPendingJoinRequests(c, conversationID)
+	if err != nil {
+		slog.Error("Failed to get join requests", "error", err)
+		return nil, err
+	}
+	res := make([]dto.JoinRequestRes, 0, len(requests))
+	for _, jr := range requests {
+		res = append(res, dto.JoinRequestRes{
+			ID:             jr.ID,
+			ConversationID: jr.ConversationID,
+			UserID:         jr.UserID,
+			Username:       jr.User.Username,
+			Avatar:         jr.User.Avatar,
+			InviteLinkID:   jr.InviteLinkID,
+			CreatedAt:      jr.CreatedAt,
+		})
+	}
+	return res, nil
+}
+
+// ApproveJoinRequest admits the user of a pending join request. The join
+// counts as a use of the link it was made through.
+func (s *convService) ApproveJoinRequest(c context.Context, conversationID uint64, actorID uint64, requestID uint64) error {
+	return s.decideJoinRequest(c, conversationID, actorID, requestID, models.JoinRequestApproved)
+}
+
+func (s *convService) RejectJoinRequest(c context.Context, conversationID uint64, actorID uint64, requestID uint64) error {
+	return s.decideJoinRequest(c, conversationID, actorID, requestID, models.JoinRequestRejected)
+}
+
+func (s *convService) decideJoinRequest(c context.Context, conversationID, actorID, requestID uint64, status models.JoinRequestStatus) error {
+	if _, _, err := s.authorize(c, conversationID, actorID, actionManageInvites); err != nil {
+		return err
+	}
+
+	jr, err := s.iRepo.GetJoinRequest(c, requestID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrJoinRequestNotFound
+		}
+		slog.Error("Failed to get join request", "error", err)
+		return err
+	}
+	if jr.ConversationID != conversationID {
+		return ErrJoinRequestNotFound
+	}
+	if jr.Status != models.JoinRequestPending {
+		return ErrJoinRequestDecided
+	}
+
+	jr.Status = status
+	jr.DecidedBy = &actorID
+	if status == models.JoinRequestApproved {
+		link, err := s.iRepo.Get(c, jr.InviteLinkID)
+		if err != nil {
+			slog.Error("Failed to get invite link", "error", err)
+			return err
+		}
+
+		// The request is only decided if the user gets in.
+		var msg *models.Message
+		err = s.tx.Transaction(c, func(tx repo.Tx) error {
+			var err error
+			if msg, err = s.admit(c, tx, link, jr.UserID, actorID, "added "+s.username(c, jr.UserID)); err != nil {
+				return err
+			}
+			return tx.Invites.UpdateJoinRequest(c, jr)
+		})
+		if !s.joinedMeanwhile(c, err, conversationID, jr.UserID) {
+			if err != nil {
+				return err
+			}
+			s.publishSystemMessages(c, msg)
+			return nil
+		}
+	}
+
+	if err := s.iRepo.UpdateJoinRequest(c, jr); err != nil {
+		slog.Error("Failed to update join request", "error", err)
+		return err
+	}
+	return nil
+}
+
+// admit makes userID a member through link within tx, using up one of
+// its uses, and returns the system message recording content from
+// actorID; channels get none. Users who are already participants are left
+// as they are.
+func (s *convService) admit(c context.Context, tx repo.Tx, link *models.InviteLink, userID uint64, actorID uint64, content string) (*models.Message, error) {
+	member, err := s.isParticipant(c, link.ConversationID, userID)
+	if err != nil || member {
+		return nil, err
+	}
+	conv, err := s.conversation(c, link.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := tx.Invites.Use(c, link.ID)
+	if err != nil {
+		slog.Error("Failed to use invite link", "error", err)
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInviteExhausted
+	}
+
+	p := &models.Participant{
+		UserID:         userID,
+		ConversationID: link.ConversationID,
+		Role:           models.ParticipantRoleMember,
+	}
+	if err := tx.Participants.Create(c, p); err != nil {
+		return nil, err
+	}
+
+	if conv.Type == models.ConversationTypeChannel {
+		return nil, nil
+	}
+	return s.newSystemMessage(c, tx.Messages, link.ConversationID, actorID, content)
+}
+
+// joinedMeanwhile reports whether admitting userID failed with err only
+// because a concurrent join made them a participant first.
+func (s *convService) joinedMeanwhile(c context.Context, err error, conversationID uint64, userID uint64) bool {
+	if err == nil || errors.Is(err, ErrInviteExhausted) {
+		return false
+	}
+	member, mErr := s.isParticipant(c, conversationID, userID)
+	if mErr != nil || !member {
+		slog.Error("Failed to add participant", "error", err)
+		return false
+	}
+	return true
+}
+
+func (s *convService) isParticipant(c context.Context, conversationID uint64, userID uint64) (bool, error) {
+	_, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	slog.Error("Failed to get participant", "error", err)
+	return false, err
+}
+
+func newInviteToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func inviteLinkRes(link *models.InviteLink) *dto.InviteLinkRes {
+	return &dto.InviteLinkRes{
+		ID:              link.ID,
+		Token:           link.Token,
+		ConversationID:  link.ConversationID,
+		CreatorID:       link.CreatorID,
+		ExpiresAt:       link.ExpiresAt,
+		MaxUses:         link.MaxUses,
+		Uses:            link.Uses,
+		RequireApproval: link.RequireApproval,
+		CreatedAt:       link.CreatedAt,
+	}
+}
@@ -2,55 +2,131 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 
 	"github.com/baohuamap/zchat-api/dto"
 	"github.com/baohuamap/zchat-api/models"
 	repo "github.com/baohuamap/zchat-api/repository"
 )
 
+// maxMessageLength is the longest message content accepted, in runes.
+const maxMessageLength = 4000
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrEmptyMessage         = errors.New("message content is required")
+	ErrMessageTooLong       = errors.New("message content is too long")
+	ErrInvalidClientMsgID   = errors.New("clientMsgId must be a UUID")
+	ErrMessageNotFound      = errors.New("message not found")
+)
+
+// MessagePublisher delivers newly created messages and conversation
+// changes to connected clients, and drops the connections of users who are
+// no longer participants.
+type MessagePublisher interface {
+	PublishMessage(m *models.Message, username string)
+	PublishConversation(conv *models.Conversation)
+	RemoveMember(conversationID uint64, userID uint64)
+}
+
 type Message interface {
-	LoadConversations(context context.Context, userID uint64) (*dto.ConversationListRes, error)
-	LoadMessages(c context.Context, conversationID uint64) (*dto.MessageListRes, error)
+	LoadConversations(context context.Context, userID uint64, filter dto.ConversationListFilter) (*dto.ConversationListRes, error)
+	LoadMessages(c context.Context, conversationID uint64, userID uint64) (*dto.MessageListRes, error)
 	SeenMessages(c context.Context, conversationID uint64, userID uint64) error
-	AddParticipants(c context.Context, conversationID uint64, userIDs []uint64) error
+	SendMessage(c context.Context, conversationID uint64, senderID uint64, username string, req *dto.SendMessageReq) (*dto.SendMessageRes, error)
 }
 
 type msgService struct {
-	cRepo repo.ConversationRepository
-	mRepo repo.MessageRepository
-	pRepo repo.ParticipantRepository
+	cRepo     repo.ConversationRepository
+	mRepo     repo.MessageRepository
+	pRepo     repo.ParticipantRepository
+	publisher MessagePublisher
 }
 
-func NewMessageService(convRepo repo.ConversationRepository, msgRepo repo.MessageRepository, participantRepo repo.ParticipantRepository) Message {
+func NewMessageService(
+	convRepo repo.ConversationRepository, msgRepo repo.MessageRepository, participantRepo repo.ParticipantRepository,
+	publisher MessagePublisher,
+) Message {
 	return &msgService{
-		cRepo: convRepo,
-		mRepo: msgRepo,
-		pRepo: participantRepo,
+		cRepo:     convRepo,
+		mRepo:     msgRepo,
+		pRepo:     participantRepo,
+		publisher: publisher,
 	}
 }
 
-func (s *msgService) LoadConversations(context context.Context, userID uint64) (*dto.ConversationListRes, error) {
+// LoadConversations lists the conversations of userID that match filter,
+// pinned ones first in pin order, then the rest by latest message.
+// Conversations the user hid stay out until a new message arrives.
+func (s *msgService) LoadConversations(context context.Context, userID uint64, filter dto.ConversationListFilter) (*dto.ConversationListRes, error) {
 	conversations, err := s.pRepo.GetConversationByParticipants(context, userID)
 	if err != nil {
 		slog.Error("Failed to get conversations", "error", err)
 		return nil, err
 	}
 
+	memberships, err := s.pRepo.GetByUserID(context, userID)
+	if err != nil {
+		slog.Error("Failed to get participants", "error", err)
+		return nil, err
+	}
+	byConversation := make(map[uint64]*models.Participant, len(memberships))
+	for i := range memberships {
+		byConversation[memberships[i].ConversationID] = &memberships[i]
+	}
+	now := time.Now()
+
+	// Channels are listed with their audience size; loading every
+	// subscriber would not scale.
+	var channelIDs []uint64
+	for _, conv := range conversations {
+		if conv.Type == models.ConversationTypeChannel {
+			channelIDs = append(channelIDs, conv.ID)
+		}
+	}
+	var subscriberCounts map[uint64]int64
+	if len(channelIDs) > 0 {
+		if subscriberCounts, err = s.pRepo.CountByConversationIDs(context, channelIDs); err != nil {
+			slog.Error("Failed to count subscribers", "error", err)
+			return nil, err
+		}
+	}
+
 	var convRes dto.ConversationListRes
 	for _, conv := range conversations {
-		participants, err := s.pRepo.GetByConversationID(context, conv.ID)
-		if err != nil {
+		me, ok := byConversation[conv.ID]
+		if !ok || me.Hidden(conv.LastSeq) {
+			continue
+		}
+		mine := settingsRes(me, now)
+		if !matches(mine, filter) {
+			continue
+		}
+
+		var participantInfos []dto.ParticipantInfo
+		var subscribers int64
+		var participants []models.Participant
+		if conv.Type == models.ConversationTypeChannel {
+			subscribers = subscriberCounts[conv.ID]
+		} else if participants, err = s.pRepo.GetByConversationID(context, conv.ID); err != nil {
 			slog.Error("Failed to get participants", "error", err)
 			return nil, err
 		}
-		var participantInfos []dto.ParticipantInfo
 		for _, p := range participants {
 			participantInfos = append(participantInfos, dto.ParticipantInfo{
 				ID:        p.UserID,
 				Phone:     p.User.Phone,
 				Username:  p.User.Username,
 				Avatar:    p.User.Avatar,
+				Avatars:   avatarURLs(&p.User),
+				Role:      string(p.Role),
 				FirstName: p.User.FirstName,
 				LastName:  p.User.LastName,
 				Email:     p.User.Email,
@@ -60,18 +136,25 @@ func (s *msgService) LoadConversations(context context.Context, userID uint64) (
 		c := dto.ConversationRes{
 			ID:                     conv.ID,
 			Name:                   conv.Name,
+			Description:            conv.Description,
+			Avatar:                 conv.Avatar,
+			Avatars:                conversationAvatarURLs(&conv),
 			Type:                   string(conv.Type),
 			CreatorID:              conv.CreatorID,
+			Public:                 conv.Public,
 			Participants:           participantInfos,
+			SubscriberCount:        subscribers,
 			Seen:                   conv.Seen,
 			LatestMessageCreatedAt: conv.CreatedAt,
+			Settings:               mine,
 		}
 		latestMessage, err := s.mRepo.GetLatestByConversationID(context, conv.ID)
 		if err != nil && err.Error() != "NotFound" {
 			slog.Error("Failed to get latest message", "error", err)
 			return nil, err
 		}
-		if latestMessage != nil {
+		// The preview respects a cleared history.
+		if latestMessage != nil && latestMessage.Seq > me.ClearedSeq {
 			c.LatestMessageID = latestMessage.ID
 			c.LatestMessageSenderID = latestMessage.SenderID
 			c.LatestMessageContent = latestMessage.Content
@@ -84,28 +167,77 @@ func (s *msgService) LoadConversations(context context.Context, userID uint64) (
 
 	}
 
+	// Conversations arrive by latest message; a stable sort keeps that
+	// order among the unpinned ones.
+	sort.SliceStable(convRes.Conversations, func(i, j int) bool {
+		a, b := convRes.Conversations[i].Settings, convRes.Conversations[j].Settings
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		return a.Pinned && a.PinOrder < b.PinOrder
+	})
+
 	return &convRes, nil
 }
 
-func (s *msgService) LoadMessages(c context.Context, conversationID uint64) (*dto.MessageListRes, error) {
-	messages, err := s.mRepo.GetByConversationID(c, conversationID)
+func matches(settings *dto.ConversationSettingsRes, filter dto.ConversationListFilter) bool {
+	if settings.Archived != filter.Archived {
+		return false
+	}
+	if filter.Muted != nil && settings.Muted != *filter.Muted {
+		return false
+	}
+	if filter.Pinned != nil && settings.Pinned != *filter.Pinned {
+		return false
+	}
+	return true
+}
+
+// LoadMessages returns the history of a conversation as userID may see it:
+// nothing up to where they cleared it and, for former participants, nothing
+// sent after they left.
+func (s *msgService) LoadMessages(c context.Context, conversationID uint64, userID uint64) (*dto.MessageListRes, error) {
+	p, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
+	var before *time.Time
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		p, err = s.pRepo.GetFormerByUserIDAndConversationID(c, userID, conversationID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotParticipant
+		}
+		before = &p.DeletedAt.Time
+	}
 	if err != nil {
+		slog.Error("Failed to get participant", "error", err)
+		return nil, err
+	}
+
+	messages, err := s.mRepo.GetByConversationIDInRange(c, conversationID, p.ClearedSeq, before)
+	if err != nil {
+		slog.Error("Failed to get messages", "error", err)
 		return nil, err
 	}
 
 	var msgRes dto.MessageListRes
-	for _, msg := range messages {
-		msgRes.Messages = append(msgRes.Messages, dto.MessageRes{
-			Content:        msg.Content,
-			SenderID:       msg.SenderID,
-			CreateAt:       msg.CreatedAt,
-			ConversationID: msg.ConversationID,
-		})
+	for i := range messages {
+		msgRes.Messages = append(msgRes.Messages, messageRes(&messages[i]))
 	}
 
 	return &msgRes, nil
 }
 
+func messageRes(msg *models.Message) dto.MessageRes {
+	return dto.MessageRes{
+		ID:             msg.ID,
+		Seq:            msg.Seq,
+		Kind:           string(msg.Kind),
+		Content:        msg.Content,
+		SenderID:       msg.SenderID,
+		CreateAt:       msg.CreatedAt,
+		ConversationID: msg.ConversationID,
+		PinnedAt:       msg.PinnedAt,
+	}
+}
+
 func (s *msgService) SeenMessages(c context.Context, conversationID uint64, userID uint64) error {
 
 	// Check if the conversation exists
@@ -152,34 +284,90 @@ func (s *msgService) SeenMessages(c context.Context, conversationID uint64, user
 
 }
 
-func (s *msgService) AddParticipants(c context.Context, conversationID uint64, userIDs []uint64) error {
-	// Check if the conversation exists
-	_, err := s.cRepo.Get(c, conversationID)
+// SendMessage validates and persists a message, then publishes it to the
+// conversation. Every transport posts through here. A resend with a known
+// ClientMsgID returns the original message without publishing it again.
+func (s *msgService) SendMessage(c context.Context, conversationID uint64, senderID uint64, username string, req *dto.SendMessageReq) (*dto.SendMessageRes, error) {
+	if req.Content == "" {
+		return nil, ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(req.Content) > maxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+
+	msg := &models.Message{
+		Content:        req.Content,
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Kind:           models.MessageKindText,
+	}
+	if req.ClientMsgID != "" {
+		id, err := uuid.Parse(req.ClientMsgID)
+		if err != nil {
+			return nil, ErrInvalidClientMsgID
+		}
+		clientMsgID := id.String()
+		msg.ClientMsgID = &clientMsgID
+	}
+
+	conv, err := s.cRepo.Get(c, conversationID)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConversationNotFound
+		}
 		slog.Error("Failed to get conversation", "error", err)
-		return err
+		return nil, err
 	}
-
-	participants := make([]models.Participant, 0)
-	for _, userID := range userIDs {
-		// Check if the user is already a participant
-		_, err := s.pRepo.GetByUserIDAndConversationID(c, userID, conversationID)
-		if err == nil {
-			slog.Info("User is already a participant", "userID", userID)
-			continue
+	sender, err := s.pRepo.GetByUserIDAndConversationID(c, senderID, conversationID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotParticipant
 		}
+		slog.Error("Failed to get participant", "error", err)
+		return nil, err
+	}
+	if !allowed(conv.Type, sender.Role, actionPost) {
+		return nil, ErrForbidden
+	}
+
+	msg, created, err := s.createMessage(c, msg)
+	if err != nil {
+		slog.Error("Failed to create message", "error", err)
+		return nil, err
+	}
+	if created {
+		s.publisher.PublishMessage(msg, username)
+	}
 
-		participants = append(participants, models.Participant{
-			UserID:         userID,
-			ConversationID: conversationID,
-		})
+	return &dto.SendMessageRes{
+		ID:          msg.ID,
+		Seq:         msg.Seq,
+		ClientMsgID: req.ClientMsgID,
+		CreatedAt:   msg.CreatedAt,
+	}, nil
+}
 
-		err = s.pRepo.BulkCreate(c, participants)
-		if err != nil {
-			slog.Error("Failed to add participant", "error", err)
-			return err
+// createMessage persists m unless its sender already sent a message with
+// the same ClientMsgID, in which case that message is returned instead.
+func (s *msgService) createMessage(c context.Context, m *models.Message) (*models.Message, bool, error) {
+	if m.ClientMsgID != nil {
+		existing, err := s.mRepo.GetBySenderIDAndClientMsgID(c, m.SenderID, *m.ClientMsgID)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, err
 		}
 	}
 
-	return nil
+	if err := s.mRepo.Create(c, m); err != nil {
+		// Lost a race with a concurrent resend: the unique index rejected us.
+		if m.ClientMsgID != nil {
+			if existing, err := s.mRepo.GetBySenderIDAndClientMsgID(c, m.SenderID, *m.ClientMsgID); err == nil {
+				return existing, false, nil
+			}
+		}
+		return nil, false, err
+	}
+	return m, true, nil
 }
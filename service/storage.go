@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/baohuamap/zchat-api/dto"
+	"github.com/baohuamap/zchat-api/models"
+	"github.com/baohuamap/zchat-api/pkg/aws"
+	repo "github.com/baohuamap/zchat-api/repository"
+)
+
+// ErrCodeQuotaExceeded is returned to clients alongside ErrQuotaExceeded.
+const ErrCodeQuotaExceeded = "storage_quota_exceeded"
+
+var (
+	ErrQuotaExceeded  = errors.New("storage quota exceeded")
+	ErrNotParticipant = errors.New("user is not a participant of the conversation")
+)
+
+const sweepBatchSize = 100
+
+// StorageConfig holds attachment quotas and retention. A zero quota or
+// retention disables that limit.
+type StorageConfig struct {
+	UserQuota         int64
+	ConversationQuota int64
+	Retention         time.Duration
+	SweepInterval     time.Duration
+}
+
+type Storage interface {
+	UploadAttachment(c context.Context, userID uint64, conversationID uint64, filename string, contentType string, size int64, file io.Reader) (*dto.AttachmentRes, error)
+	GetUsage(c context.Context, userID uint64) (*dto.StorageUsageRes, error)
+	Sweep(c context.Context) (int, error)
+	RunSweeper(c context.Context)
+}
+
+type storageService struct {
+	aRepo    repo.AttachmentRepository
+	pRepo    repo.ParticipantRepository
+	s3Client aws.S3Client
+	cfg      StorageConfig
+}
+
+func NewStorageService(attachmentRepo repo.AttachmentRepository, participantRepo repo.ParticipantRepository, s3 aws.S3Client, cfg StorageConfig) Storage {
+	return &storageService{
+		aRepo:    attachmentRepo,
+		pRepo:    participantRepo,
+		s3Client: s3,
+		cfg:      cfg,
+	}
+}
+
+func (s *storageService) UploadAttachment(c context.Context, userID uint64, conversationID uint64, filename string, contentType string, size int64, file io.Reader) (*dto.AttachmentRes, error) {
+	ctx, cancel := context.WithTimeout(c, 60*time.Second)
+	defer cancel()
+
+	if _, err := s.pRepo.GetByUserIDAndConversationID(ctx, userID, conversationID); err != nil {
+		slog.Error("User is not a participant", "userID", userID, "conversationID", conversationID)
+		return nil, ErrNotParticipant
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	filename = filepath.Base(filename)
+	key := strconv.FormatUint(conversationID, 10) + "/attachments/" + hex.EncodeToString(suffix) + "/" + filename
+
+	a := &models.Attachment{
+		Key:            key,
+		Filename:       filename,
+		ContentType:    contentType,
+		Size:           size,
+		UploaderID:     userID,
+		ConversationID: conversationID,
+	}
+	if s.cfg.Retention > 0 {
+		expiresAt := time.Now().Add(s.cfg.Retention)
+		a.ExpiresAt = &expiresAt
+	}
+
+	// The row reserves its size against the quotas before the upload, so
+	// concurrent uploads cannot overshoot them together.
+	ok, err := s.aRepo.CreateWithinQuota(ctx, a, s.cfg.UserQuota, s.cfg.ConversationQuota)
+	if err != nil {
+		slog.Error("Error saving attachment", "userID", userID, "error", err)
+		return nil, err
+	}
+	if !ok {
+		slog.Info("Storage quota exceeded", "userID", userID, "conversationID", conversationID, "size", size)
+		return nil, ErrQuotaExceeded
+	}
+
+	// Never store more than was declared and checked against the quota.
+	if err := s.s3Client.PutObject(ctx, key, io.LimitReader(file, size), contentType); err != nil {
+		slog.Error("Error uploading attachment", "userID", userID, "error", err)
+		if err := s.aRepo.Delete(ctx, a.ID); err != nil {
+			slog.Error("Error releasing attachment reservation", "attachmentID", a.ID, "error", err)
+		}
+		return nil, err
+	}
+
+	return &dto.AttachmentRes{
+		ID:             a.ID,
+		URL:            s.s3Client.GetFileURL(key),
+		Filename:       a.Filename,
+		ContentType:    a.ContentType,
+		Size:           a.Size,
+		ConversationID: a.ConversationID,
+		ExpiresAt:      a.ExpiresAt,
+	}, nil
+}
+
+func (s *storageService) GetUsage(c context.Context, userID uint64) (*dto.StorageUsageRes, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	usage, err := s.aRepo.SumSizeByUploaderIDGroupByConversation(ctx, userID)
+	if err != nil {
+		slog.Error("Error getting storage usage", "userID", userID, "error", err)
+		return nil, err
+	}
+
+	res := &dto.StorageUsageRes{
+		QuotaBytes:    s.cfg.UserQuota,
+		Conversations: make([]dto.ConversationStorageRes, 0, len(usage)),
+	}
+	for _, u := range usage {
+		res.UsedBytes += u.Size
+		res.Conversations = append(res.Conversations, dto.ConversationStorageRes{
+			ConversationID: u.ConversationID,
+			UsedBytes:      u.Size,
+			QuotaBytes:     s.cfg.ConversationQuota,
+		})
+	}
+
+	return res, nil
+}
+
+// Sweep deletes the S3 objects and rows of expired or orphaned attachments
+// and reports how many were removed.
+func (s *storageService) Sweep(c context.Context) (int, error) {
+	expired, err := s.aRepo.GetExpired(c, time.Now(), sweepBatchSize)
+	if err != nil {
+		slog.Error("Error getting expired attachments", "error", err)
+		return 0, err
+	}
+	orphaned, err := s.aRepo.GetOrphaned(c, sweepBatchSize)
+	if err != nil {
+		slog.Error("Error getting orphaned attachments", "error", err)
+		return 0, err
+	}
+
+	removed := 0
+	for _, a := range append(expired, orphaned...) {
+		if err := s.s3Client.DeleteFile(c, a.Key); err != nil {
+			slog.Error("Error deleting attachment object", "attachmentID", a.ID, "error", err)
+			continue
+		}
+		if err := s.aRepo.Delete(c, a.ID); err != nil {
+			slog.Error("Error deleting attachment", "attachmentID", a.ID, "error", err)
+			continue
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// RunSweeper calls Sweep every SweepInterval until c is done.
+func (s *storageService) RunSweeper(c context.Context) {
+	if s.cfg.SweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+			removed, err := s.Sweep(c)
+			if err != nil {
+				continue
+			}
+			if removed > 0 {
+				slog.Info("Swept attachments", "removed", removed)
+			}
+		}
+	}
+}
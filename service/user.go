@@ -2,8 +2,8 @@ package service
 
 import (
 	"context"
+	"io"
 	"log/slog"
-	"mime/multipart"
 	"strconv"
 	"time"
 
@@ -16,10 +16,6 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
-const (
-	secretKey = "secret"
-)
-
 type User interface {
 	CreateUser(c context.Context, req *dto.CreateUserReq) (*dto.CreateUserRes, error)
 	Login(c context.Context, req *dto.LoginUserReq) (*dto.LoginUserRes, error)
@@ -30,9 +26,10 @@ type User interface {
 	GetSentFriendRequests(c context.Context, userID uint64) (*dto.SentFriendRequestsRes, error)
 	GetReceivedFriendRequests(c context.Context, userID uint64) (*dto.ReceivedFriendRequestsRes, error)
 	GetFriends(c context.Context, userID uint64, search string) ([]models.User, error)
-	UploadAvatar(c context.Context, userID uint64, filename string, file *multipart.File) (*dto.UploadAvatarRes, error)
+	UploadAvatar(c context.Context, userID uint64, file io.Reader) (*dto.UploadAvatarRes, error)
 	FindUsers(c context.Context, userID uint64, search string) (*dto.FindUserListRes, error)
 	GetUser(c context.Context, userID uint64) (*dto.GetUserRes, error)
+	UpdatePrivacy(c context.Context, userID uint64, req *dto.UpdatePrivacyReq) (*dto.GetUserRes, error)
 }
 
 type service struct {
@@ -103,7 +100,7 @@ func (s *service) Login(c context.Context, req *dto.LoginUserReq) (*dto.LoginUse
 		},
 	})
 
-	ss, err := token.SignedString([]byte(secretKey))
+	ss, err := token.SignedString([]byte(util.JWTSecretKey))
 	if err != nil {
 		return &dto.LoginUserRes{}, err
 	}
@@ -252,6 +249,7 @@ func (s *service) GetSentFriendRequests(c context.Context, userID uint64) (*dto.
 				FirstName: friend.FirstName,
 				LastName:  friend.LastName,
 				Avatar:    friend.Avatar,
+				Avatars:   avatarURLs(friend),
 				CreatedAt: friendship.CreatedAt,
 				Status:    friendship.Status,
 			})
@@ -294,6 +292,7 @@ func (s *service) GetReceivedFriendRequests(c context.Context, userID uint64) (*
 				FirstName: friend.FirstName,
 				LastName:  friend.LastName,
 				Avatar:    friend.Avatar,
+				Avatars:   avatarURLs(friend),
 				CreatedAt: friendship.CreatedAt,
 				Status:    friendship.Status,
 			})
@@ -346,12 +345,17 @@ func (s *service) GetFriends(c context.Context, userID uint64, search string) ([
 		slog.Error("Error getting friends", "userID", userID)
 		return nil, err
 	}
+	for i := range friends {
+		if friends[i].HideLastSeen {
+			friends[i].LastSeenAt = nil
+		}
+	}
 
 	return friends, nil
 }
 
-func (s *service) UploadAvatar(c context.Context, userID uint64, filename string, file *multipart.File) (*dto.UploadAvatarRes, error) {
-	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+func (s *service) UploadAvatar(c context.Context, userID uint64, file io.Reader) (*dto.UploadAvatarRes, error) {
+	ctx, cancel := context.WithTimeout(c, 30*time.Second)
 	defer cancel()
 
 	// Check if user exists
@@ -361,26 +365,40 @@ func (s *service) UploadAvatar(c context.Context, userID uint64, filename string
 		return nil, err
 	}
 
-	// Upload file to s3
-	err = s.s3Client.UploadFile(ctx, strconv.FormatUint(userID, 10)+"/avatar/"+filename, file)
+	avatar, err := uploadAvatar(ctx, s.s3Client, strconv.FormatUint(userID, 10)+"/avatar", file)
 	if err != nil {
-		slog.Error("Error uploading file", "userID", userID, "error", err)
+		slog.Error("Error uploading avatar", "userID", userID, "error", err)
 		return nil, err
 	}
 
-	// Get file URL
-	fileURL := s.s3Client.GetFileURL(strconv.FormatUint(userID, 10) + "/avatar/" + filename)
-	user.Avatar = fileURL
+	oldKey := user.AvatarKey
+	user.AvatarKey = avatar.key
+	user.AvatarSmall = avatar.urls[avatarSizes[0]]
+	user.AvatarMedium = avatar.urls[avatarSizes[1]]
+	user.AvatarLarge = avatar.urls[avatarSizes[2]]
+	user.Avatar = user.AvatarMedium
 	if err := s.repo.Update(ctx, user); err != nil {
 		slog.Error("Error updating user avatar", "userID", userID, "error", err)
 		return nil, err
 	}
 
+	// Old variants are only removed once the user row points at the new ones.
+	deleteAvatar(ctx, s.s3Client, oldKey, avatar.key)
+
 	return &dto.UploadAvatarRes{
-		URL: user.Avatar,
+		URL:     user.Avatar,
+		Avatars: avatarURLs(user),
 	}, nil
 }
 
+func avatarURLs(u *models.User) dto.AvatarURLs {
+	return dto.AvatarURLs{
+		Small:  u.AvatarSmall,
+		Medium: u.AvatarMedium,
+		Large:  u.AvatarLarge,
+	}
+}
+
 func (s *service) FindUsers(c context.Context, userID uint64, search string) (*dto.FindUserListRes, error) {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
@@ -401,6 +419,7 @@ func (s *service) FindUsers(c context.Context, userID uint64, search string) (*d
 			FirstName: u.FirstName,
 			LastName:  u.LastName,
 			Avatar:    u.Avatar,
+			Avatars:   avatarURLs(&u),
 			CreatedAt: u.CreatedAt,
 			UpdatedAt: u.UpdatedAt,
 		})
@@ -419,17 +438,51 @@ func (s *service) GetUser(c context.Context, userID uint64) (*dto.GetUserRes, er
 		return nil, err
 	}
 
-	res := &dto.GetUserRes{
-		ID:        strconv.FormatUint(u.ID, 10),
-		Username:  u.Username,
-		Email:     u.Email,
-		Phone:     u.Phone,
-		FirstName: u.FirstName,
-		LastName:  u.LastName,
-		Avatar:    u.Avatar,
-		CreatedAt: u.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: u.UpdatedAt.Format(time.RFC3339),
+	return getUserRes(u), nil
+}
+
+func (s *service) UpdatePrivacy(c context.Context, userID uint64, req *dto.UpdatePrivacyReq) (*dto.GetUserRes, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	u, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		slog.Error("User not found", "userID", userID)
+		return nil, err
 	}
 
-	return res, nil
+	if req.HideLastSeen != nil {
+		u.HideLastSeen = *req.HideLastSeen
+	}
+	if req.AllowStrangers != nil {
+		u.AllowStrangers = *req.AllowStrangers
+	}
+	if err := s.repo.Update(ctx, u); err != nil {
+		slog.Error("Error updating privacy settings", "userID", userID, "error", err)
+		return nil, err
+	}
+
+	return getUserRes(u), nil
+}
+
+func getUserRes(u *models.User) *dto.GetUserRes {
+	res := &dto.GetUserRes{
+		ID:             strconv.FormatUint(u.ID, 10),
+		Username:       u.Username,
+		Email:          u.Email,
+		Phone:          u.Phone,
+		FirstName:      u.FirstName,
+		LastName:       u.LastName,
+		Avatar:         u.Avatar,
+		Avatars:        avatarURLs(u),
+		HideLastSeen:   u.HideLastSeen,
+		AllowStrangers: u.AllowStrangers,
+		CreatedAt:      u.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:      u.UpdatedAt.Format(time.RFC3339),
+	}
+	if !u.HideLastSeen {
+		res.LastSeenAt = u.LastSeenAt
+	}
+
+	return res
 }
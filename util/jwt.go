@@ -0,0 +1,6 @@
+package util
+
+const (
+	// JWTSecretKey signs and verifies access tokens.
+	JWTSecretKey = "secret"
+)